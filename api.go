@@ -1,10 +1,18 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
+// Hidden records are only visible to those that can unhide them.
+func canView(record *Record, req *http.Request) bool {
+	return !record.Hidden || authenticate(req).Can(record.GuildId, PermHide)
+}
+
 func apiRecord(writer http.ResponseWriter, req *http.Request) int {
 	if req.Method != http.MethodGet {
 		return respCode(http.StatusMethodNotAllowed, writer, req)
@@ -15,13 +23,111 @@ func apiRecord(writer http.ResponseWriter, req *http.Request) int {
 		return respCode(http.StatusNotFound, writer, req)
 	}
 
-	if record := DatabaseRecord(guild, rec); record == nil {
+	if record := DatabaseRecord(guild, rec); record == nil || !canView(record, req) {
 		return respCode(http.StatusNotFound, writer, req)
+	} else if record.Deleted {
+		return respCode(http.StatusGone, writer, req)
 	} else {
 		return respJson(record, writer, req)
 	}
 }
 
+const tagsMax = 50
+
+// Tags added by hand are restricted to the characters found in the tags we
+// generate. Removals aren't restricted such that any tag can be cleaned up.
+var tagWriteRegex = regexp.MustCompile(`^[\p{L}\p{N}\p{M}_\-.:@#]+$`)
+
+// POST|DELETE /api/record/<guild>/<id>/tags {"tags": [<tag>, ...]}
+func apiRecordTags(writer http.ResponseWriter, req *http.Request) int {
+	if req.Method != http.MethodPost && req.Method != http.MethodDelete {
+		return respCode(http.StatusMethodNotAllowed, writer, req)
+	}
+
+	ok, guild, rec := parseRecordSubPath(req, "tags")
+	if !ok {
+		return respCode(http.StatusNotFound, writer, req)
+	}
+
+	principal, code := authorize(guild, PermTag, writer, req)
+	if principal == nil {
+		return code
+	}
+
+	body := struct {
+		Tags []string `json:"tags"`
+	}{}
+	if err := parseJson(&body, writer, req); err != nil {
+		return respError(http.StatusBadRequest, err, writer, req)
+	}
+
+	if len(body.Tags) == 0 || len(body.Tags) > tagsMax {
+		return respError(http.StatusBadRequest,
+			fmt.Errorf("expected between 1 and %v tags", tagsMax), writer, req)
+	}
+
+	for _, tag := range body.Tags {
+		if ok, parsed := (Query{}).parseTag(tag); !ok || parsed == "" {
+			return respError(http.StatusBadRequest, fmt.Errorf("invalid tag '%v'", tag), writer, req)
+		} else if req.Method == http.MethodPost && !tagWriteRegex.MatchString(tag) {
+			return respError(http.StatusBadRequest, fmt.Errorf("invalid tag '%v'", tag), writer, req)
+		}
+	}
+
+	if record := DatabaseRecord(guild, rec); record == nil {
+		return respCode(http.StatusNotFound, writer, req)
+	} else if record.Deleted {
+		return respCode(http.StatusGone, writer, req)
+	}
+
+	if req.Method == http.MethodPost {
+		DatabaseTagsSet(principal.Actor, rec, body.Tags)
+	} else {
+		DatabaseTagsUnset(principal.Actor, rec, body.Tags)
+	}
+
+	Info("tags %v %v -> %v %v", principal.Actor, req.Method, rec, body.Tags)
+	return respJson(DatabaseRecord(guild, rec), writer, req)
+}
+
+// POST|DELETE /api/record/<guild>/<id>/hide
+func apiRecordHide(writer http.ResponseWriter, req *http.Request) int {
+	if req.Method != http.MethodPost && req.Method != http.MethodDelete {
+		return respCode(http.StatusMethodNotAllowed, writer, req)
+	}
+
+	ok, guild, rec := parseRecordSubPath(req, "hide")
+	if !ok {
+		return respCode(http.StatusNotFound, writer, req)
+	}
+
+	principal, code := authorize(guild, PermHide, writer, req)
+	if principal == nil {
+		return code
+	}
+
+	if record := DatabaseRecord(guild, rec); record == nil {
+		return respCode(http.StatusNotFound, writer, req)
+	} else if record.Deleted {
+		return respCode(http.StatusGone, writer, req)
+	}
+
+	DatabaseRecordHide(principal.Actor, rec, req.Method == http.MethodPost)
+
+	Info("hide %v %v -> %v", principal.Actor, req.Method, rec)
+	return respJson(DatabaseRecord(guild, rec), writer, req)
+}
+
+func apiRecordRoute(writer http.ResponseWriter, req *http.Request) int {
+	if strings.HasSuffix(req.URL.Path, "/tags") {
+		return apiRecordTags(writer, req)
+	}
+	if strings.HasSuffix(req.URL.Path, "/hide") {
+		return apiRecordHide(writer, req)
+	}
+	return apiRecord(writer, req)
+}
+
 func assetsRecord(writer http.ResponseWriter, req *http.Request) int {
 	if req.Method != http.MethodGet {
 		return respCode(http.StatusMethodNotAllowed, writer, req)
@@ -32,10 +138,18 @@ func assetsRecord(writer http.ResponseWriter, req *http.Request) int {
 		return respCode(http.StatusNotFound, writer, req)
 	}
 
-	if record := DatabaseRecord(guild, rec); record == nil {
+	if record := DatabaseRecord(guild, rec); record == nil || !canView(record, req) {
 		return respCode(http.StatusNotFound, writer, req)
+	} else if record.Deleted {
+		return respCode(http.StatusGone, writer, req)
+	} else if url, err := CdnUrl(record); err == errCdnGone {
+		DatabaseRecordDeleteImage(ActorCdn, record.ImageId)
+		return respCode(http.StatusGone, writer, req)
+	} else if err != nil {
+		Warning("unable to get url for '%v': %v", record.Id, err)
+		return respCode(http.StatusBadGateway, writer, req)
 	} else {
-		http.Redirect(writer, req, record.Path, http.StatusFound)
+		http.Redirect(writer, req, url, http.StatusFound)
 		return http.StatusFound
 	}
 }
@@ -45,18 +159,150 @@ func apiQuery(writer http.ResponseWriter, req *http.Request) int {
 		return respCode(http.StatusMethodNotAllowed, writer, req)
 	}
 
-	if ok, query := NewQuery(req.URL); !ok {
+	if query, err := NewQuery(req.URL); err == errQueryPath {
 		return respCode(http.StatusNotFound, writer, req)
+	} else if err != nil {
+		return respError(http.StatusBadRequest, err, writer, req)
 	} else {
-		return respJson(DatabaseQuery(query), writer, req)
+		result := DatabaseQuery(query)
+		if query.Embed {
+			result.Records = DatabaseRecordsBatch(query.GuildId, result.Ids)
+		}
+		return respJson(result, writer, req)
+	}
+}
+
+const recordsMaxIds = 100
+
+func apiRecords(writer http.ResponseWriter, req *http.Request) int {
+	if req.Method != http.MethodGet {
+		return respCode(http.StatusMethodNotAllowed, writer, req)
+	}
+
+	ok, guild := parseGuildPath(req, "records")
+	if !ok {
+		return respCode(http.StatusNotFound, writer, req)
+	}
+
+	ids := []int64{}
+	for _, item := range strings.Split(req.URL.Query().Get("ids"), ",") {
+		if item == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			return respError(http.StatusBadRequest, fmt.Errorf("invalid id '%v'", item), writer, req)
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) > recordsMaxIds {
+		return respError(http.StatusBadRequest,
+			fmt.Errorf("more than %v ids requested", recordsMaxIds), writer, req)
+	}
+
+	return respJson(DatabaseRecordsBatch(guild, ids), writer, req)
+}
+
+// GET /api/audit/<guild>?...
+// POST /api/audit/<guild>/<id>/revert
+func apiAudit(writer http.ResponseWriter, req *http.Request) int {
+	items := strings.Split(req.URL.Path, "/")
+	if len(items) == 6 && items[5] == "revert" {
+		return apiAuditRevert(writer, req, items[3], items[4])
+	}
+
+	if req.Method != http.MethodGet {
+		return respCode(http.StatusMethodNotAllowed, writer, req)
+	}
+
+	ok, guild := parseGuildPath(req, "audit")
+	if !ok {
+		return respCode(http.StatusNotFound, writer, req)
+	}
+
+	if principal, code := authorize(guild, PermAdmin, writer, req); principal == nil {
+		return code
+	}
+
+	query, err := NewAuditQuery(guild, req.URL)
+	if err != nil {
+		return respError(http.StatusBadRequest, err, writer, req)
+	}
+
+	return respJson(DatabaseAudit(query), writer, req)
+}
+
+func apiAuditRevert(writer http.ResponseWriter, req *http.Request, guild, rawId string) int {
+	if req.Method != http.MethodPost {
+		return respCode(http.StatusMethodNotAllowed, writer, req)
 	}
+
+	id, err := strconv.ParseInt(rawId, 10, 64)
+	if err != nil {
+		return respCode(http.StatusNotFound, writer, req)
+	}
+
+	principal, code := authorize(guild, PermAdmin, writer, req)
+	if principal == nil {
+		return code
+	}
+
+	revert, err := DatabaseAuditRevert(principal.Actor, guild, id)
+	switch err {
+	case nil:
+	case errAuditNotFound:
+		return respCode(http.StatusNotFound, writer, req)
+	case errAuditReverted, errAuditConflict:
+		return respError(http.StatusConflict, err, writer, req)
+	default:
+		return respError(http.StatusBadRequest, err, writer, req)
+	}
+
+	Info("revert %v -> %v by %v", id, revert, principal.Actor)
+	return respJson(DatabaseAudit(AuditQuery{GuildId: guild, Before: revert + 1, Limit: 1}), writer, req)
 }
 
+// GET /api/stats/<guild>
 func apiStats(writer http.ResponseWriter, req *http.Request) int {
 	if req.Method != http.MethodGet {
 		return respCode(http.StatusMethodNotAllowed, writer, req)
 	}
-	return respJson(DatabaseStats(), writer, req)
+
+	items := strings.Split(req.URL.Path, "/")
+	if len(items) != 4 {
+		return respCode(http.StatusNotFound, writer, req)
+	}
+	return respJson(DatabaseStats(items[3]), writer, req)
+}
+
+// GET /api/stats
+//
+// Kept for the clients that predate the per-guild stats. Sums up the stats of
+// the guilds readable by the client.
+func apiStatsAll(writer http.ResponseWriter, req *http.Request) int {
+	if req.Method != http.MethodGet {
+		return respCode(http.StatusMethodNotAllowed, writer, req)
+	}
+
+	principal := authenticate(req)
+	stats := &Stats{Tags: make(map[string]int64)}
+	for _, guild := range DatabaseSubGuilds() {
+		if !authPublic(guild) && !principal.Can(guild, PermRead) {
+			continue
+		}
+
+		guildStats := DatabaseStats(guild)
+		stats.RecordsRows += guildStats.RecordsRows
+		stats.TagsRows += guildStats.TagsRows
+		for tag, count := range guildStats.Tags {
+			stats.Tags[tag] += count
+		}
+	}
+	stats.TagsDistinct = int64(len(stats.Tags))
+
+	return respJson(stats, writer, req)
 }
 
 func htmlFile(writer http.ResponseWriter, req *http.Request) int {
@@ -70,16 +316,33 @@ func redirectTLS(w http.ResponseWriter, r *http.Request) {
 }
 
 func ApiInit() {
-	http.HandleFunc("/api/record/", wrap(apiRecord))
-	http.HandleFunc("/api/query/", wrap(apiQuery))
-	http.HandleFunc("/api/stats", wrap(apiStats))
+	LimitInit()
+	RolesInit()
+	OauthInit()
 
-	http.HandleFunc("/asset/record/", wrap(assetsRecord))
+	http.HandleFunc("/api/record/", wrap(limit("api", guard(3, false, apiRecordRoute))))
+	http.HandleFunc("/api/records/", wrap(limit("api", guard(3, false, apiRecords))))
+	http.HandleFunc("/api/query/", wrap(limit("api", guard(3, false, apiQuery))))
+	http.HandleFunc("/api/audit/", wrap(limit("api", guard(3, false, apiAudit))))
+	http.HandleFunc("/api/stats", wrap(limit("api", apiStatsAll)))
+	http.HandleFunc("/api/stats/", wrap(limit("api", guard(3, false, apiStats))))
 
-	http.HandleFunc("/gallery/", wrap(htmlFile))
-	http.HandleFunc("/record/", wrap(htmlFile))
+	http.HandleFunc("/asset/record/", wrap(limit("asset", guard(3, false, assetsRecord))))
+
+	http.HandleFunc("/gallery/", wrap(limit("page", guard(2, true, htmlFile))))
+	http.HandleFunc("/record/", wrap(limit("page", guard(2, true, htmlFile))))
 	http.Handle("/", http.FileServer(http.Dir(asset(""))))
 
+	if Config.Http.BindAdmin != "" {
+		admin := http.NewServeMux()
+		admin.HandleFunc("/debug/throttled", wrap(limitStats))
+		go func() {
+			if err := http.ListenAndServe(Config.Http.BindAdmin, admin); err != nil {
+				Fatal("ERROR ListenAndServe error: %v", err)
+			}
+		}()
+	}
+
 	if Config.Http.BindTls != "" {
 		go func() {
 			err := http.ListenAndServeTLS(Config.Http.BindTls, Config.Http.TlsCert, Config.Http.TlsKey, nil)
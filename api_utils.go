@@ -8,9 +8,32 @@ import (
 	"time"
 )
 
+func parseGuildPath(req *http.Request, kind string) (bool, string) {
+	items := strings.Split(req.URL.Path, "/")
+	if len(items) != 4 || items[2] != kind {
+		return false, ""
+	}
+
+	guild := items[3]
+	if _, err := strconv.ParseInt(guild, 10, 64); err != nil {
+		return false, ""
+	}
+
+	return true, guild
+}
+
 func parseRecordPath(req *http.Request) (bool, string, int64) {
+	return parseRecordSubPath(req, "")
+}
+
+// Parses /<root>/record/<guild>/<id>[/<sub>]
+func parseRecordSubPath(req *http.Request, sub string) (bool, string, int64) {
 	items := strings.Split(req.URL.Path, "/")
-	if len(items) != 5 || items[2] != "record" {
+	if sub == "" && len(items) != 5 {
+		return false, "", -1
+	} else if sub != "" && (len(items) != 6 || items[5] != sub) {
+		return false, "", -1
+	} else if items[2] != "record" {
 		return false, "", -1
 	}
 
@@ -32,6 +55,24 @@ func respCode(code int, writer http.ResponseWriter, req *http.Request) int {
 	return code
 }
 
+func respError(code int, err error, writer http.ResponseWriter, req *http.Request) int {
+	bytes, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(code)
+	writer.Write(bytes)
+	return code
+}
+
+const reqMaxBody = 64 * 1024
+
+func parseJson(value interface{}, writer http.ResponseWriter, req *http.Request) error {
+	body := http.MaxBytesReader(writer, req.Body, reqMaxBody)
+	return json.NewDecoder(body).Decode(value)
+}
+
 func respJson(resp interface{}, writer http.ResponseWriter, req *http.Request) int {
 	if resp == nil {
 		return respCode(http.StatusNoContent, writer, req)
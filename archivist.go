@@ -10,23 +10,79 @@ import (
 )
 
 var configPath = flag.String("config", "./archivist.json", "JSON config")
+var migrateOnly = flag.Bool("migrate-only", false, "Apply the database migrations and exit")
+var migrateDryRun = flag.Bool("migrate-dry-run", false, "List the pending database migrations and exit")
+
+var keyMint = flag.String("key-mint", "", "Mint an API key with the given name and exit")
+var keyGuilds = flag.String("key-guilds", "", "Comma separated guilds the minted key has access to")
+var keyPerms = flag.String("key-perms", "read", "Comma separated permissions of the minted key: read, tag, hide, admin")
+var keyList = flag.Bool("key-list", false, "List the API keys and exit")
+var keyRevoke = flag.Int64("key-revoke", 0, "Revoke the API key with the given id and exit")
+
+var authorsReconcile = flag.Bool("authors-reconcile", false, "Link the archived records to their authors and exit")
+var rulesApply = flag.Bool("rules-apply", false, "Re-apply the tagging rules to the archived records and exit")
+
 var Config struct {
 	Database string `json:"db"`
 
 	Discord struct {
 		Token string              `json:"token"`
+		Api   string              `json:"api"`
 		Subs  map[string][]string `json:"subs"`
+
+		// Seconds between refreshes of the guild and channel metadata.
+		Refresh int `json:"refresh"`
+
+		// Number of channel pages fetched concurrently.
+		Workers int `json:"workers"`
 	} `json:"discord"`
 
+	Auth struct {
+		ClientId     string   `json:"client_id"`
+		ClientSecret string   `json:"client_secret"`
+		RedirectUrl  string   `json:"redirect_url"`
+		SessionKey   string   `json:"session_key"`
+		Public       []string `json:"public"`
+
+		// Static tokens that predate the API keys which are kept working
+		// for the existing curators. New curators should get a key instead.
+		Curators []struct {
+			Name   string   `json:"name"`
+			Token  string   `json:"token"`
+			Guilds []string `json:"guilds"`
+		} `json:"curators"`
+
+		// guild -> role -> permissions
+		Roles   map[string]map[string][]string `json:"roles"`
+		RoleTtl int                            `json:"role_ttl"`
+	} `json:"auth"`
+
 	Http struct {
 		Assets string `json:"assets"`
 
 		Bind    string `json:"bind"`
 		BindTls string `json:"bind_tls"`
 
+		// Serves the internal counters and should not be reachable from
+		// the outside.
+		BindAdmin string `json:"bind_admin"`
+
 		TlsCert string `json:"tls_cert"`
 		TlsKey  string `json:"tls_key"`
+
+		// Keyed by route group: api, asset, page and login.
+		RateLimits map[string]struct {
+			Rate  float64 `json:"rate"`
+			Burst int     `json:"burst"`
+		} `json:"rate_limits"`
+		TrustedProxies []string `json:"trusted_proxies"`
 	} `json:"http"`
+
+	// guild -> tagging rules
+	Rules map[string][]RuleConfig `json:"rules"`
+
+	// guild -> emoji name -> tag
+	Reactions map[string]map[string]string `json:"reactions"`
 }
 
 func ConfigLoad() {
@@ -49,13 +105,29 @@ func ConfigLoad() {
 func main() {
 	ConfigLoad()
 
-	DatabaseOpen(Config.Database)
+	DatabaseOpen(Config.Database, *migrateDryRun)
 	defer DatabaseClose()
 
+	DatabaseMigrate(Config.Database, *migrateDryRun)
+	if *migrateOnly || *migrateDryRun {
+		return
+	}
+
+	if KeyCommand() || RulesCommand() {
+		return
+	}
+
 	DiscordConnect()
 	defer DiscordClose()
 
+	if AuthorsCommand() {
+		return
+	}
+
+	RulesInit()
+	BotInit()
 	ScrapperStart()
+	AuthorsStart()
 	ApiInit()
 
 	Info("Started")
@@ -7,7 +7,12 @@ var archive = {
 
     path: {
         api: {
-            query:  function ()   { return "/api/query/" + archive.url.guild + archive.url.qs; },
+            query:  function (cursor) {
+                let qs = new URLSearchParams(archive.url.qs);
+                qs.set("embed", "true");
+                if (cursor) qs.set("cursor", cursor);
+                return "/api/query/" + archive.url.guild + "?" + qs.toString();
+            },
             record: function (id) { return "/api/record/" + archive.url.guild + "/" + id; }
         },
 
@@ -32,12 +37,20 @@ var archive = {
     },
 
     data: {
-        tags: new Set()
+        tags: new Set(),
+        next: null,
+        loading: false
+    },
+
+    // Captions and tags are written by users and must never be rendered as html.
+    escape: function (text) {
+        return $("<div>").text(text).html().replace(/"/g, "&quot;");
     },
 
     nav: function() {
         let html = [];
         html.push(`<a href="`+archive.path.page.gallery()+`">Top</a>`);
+        html.push(` <a href="/login?next=`+encodeURIComponent(location.pathname + location.search)+`">Login</a>`);
         $("#nav").html(html.join(""));
     },
 
@@ -49,7 +62,7 @@ var archive = {
                 let html = [];
 
                 if (record.caption !== "") {
-                    html.push(`<div id="caption">`+record.caption+`</div>`);
+                    html.push(`<div id="caption">`+archive.escape(record.caption)+`</div>`);
                 }
 
                 html.push(`<div id="image">`);
@@ -76,19 +89,36 @@ var archive = {
     },
 
     gallery: function () {
-        $.getJSON(archive.path.api.query(), archive.renderRecords);
+        archive.loadRecords(null);
+        $(window).on("scroll", archive.scroll);
+    },
+
+    loadRecords: function (cursor) {
+        archive.data.loading = true;
+        $.getJSON(archive.path.api.query(cursor), archive.renderRecords);
     },
 
-    renderRecords: function (records) {
-        for (let record of records) {
-            $("div#records").append(`<div id="`+record+`" class="record" />`);
-            $.getJSON(archive.path.api.record(record), archive.renderRecord);
+    scroll: function () {
+        if (archive.data.loading || !archive.data.next) return;
+
+        let bottom = $(window).scrollTop() + $(window).height();
+        if (bottom >= $(document).height() - 400) {
+            archive.loadRecords(archive.data.next);
+        }
+    },
+
+    renderRecords: function (result) {
+        archive.data.next = result.next;
+        archive.data.loading = false;
+
+        for (let record of result.records || []) {
+            $("div#records").append(`<div id="`+record.id+`" class="record" />`);
+            archive.renderRecord(record);
         };
     },
 
     renderRecord: function (record) {
         archive.renderTags(record.tags)
-        archive.cursor = "img:"+record.img_id
 
         let html = [];
         html.push(`<a href="`+archive.path.page.record(record.id)+`">`);
@@ -117,7 +147,7 @@ var archive = {
     renderTag: function (tag) {
         let html = []
         html.push(`<div class="tag">`)
-        html.push(`  <a href="`+archive.path.page.gallery()+`?tag=`+encodeURIComponent(tag)+`">`+tag+`</a>`)
+        html.push(`  <a href="`+archive.path.page.gallery()+`?tag=`+encodeURIComponent(tag)+`">`+archive.escape(tag)+`</a>`)
         html.push(`</div>`)
         return html.join("")
     }
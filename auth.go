@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Write operations require the client to authenticate and to be authorized on
+// the guild it's modifying. Each authenticator inspects the request and
+// returns the principal it identifies or nil if it doesn't recognize the
+// request.
+
+// Permissions are stored as integers in the keys table so new permissions
+// must be appended to keep the existing bits stable.
+type Perm int
+
+const (
+	PermRead Perm = 1 << iota
+	PermTag
+	PermAdmin
+	PermHide
+
+	PermAll = PermRead | PermTag | PermHide | PermAdmin
+)
+
+var permNames = map[string]Perm{
+	"read":  PermRead,
+	"view":  PermRead,
+	"tag":   PermTag,
+	"hide":  PermHide,
+	"admin": PermAdmin,
+}
+
+func ParsePerms(names []string) (Perm, error) {
+	var perms Perm
+	for _, name := range names {
+		perm, ok := permNames[strings.TrimSpace(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown permission '%v'", name)
+		}
+		perms |= perm
+	}
+
+	// Admins can do anything.
+	if perms&PermAdmin != 0 {
+		perms |= PermAll
+	}
+	return perms, nil
+}
+
+func (perms Perm) String() string {
+	names := []string{}
+	for _, name := range []string{"read", "tag", "hide", "admin"} {
+		if perms&permNames[name] != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Permissions are resolved lazily as they might require a round-trip to
+// Discord.
+type Principal struct {
+	Actor string
+	perms func(guild string) Perm
+}
+
+func (principal *Principal) Can(guild string, perm Perm) bool {
+	return principal != nil && principal.perms(guild)&perm == perm
+}
+
+var authenticators = []func(*http.Request) *Principal{
+	authKey,
+	authCurator,
+	authSession,
+}
+
+func authenticate(req *http.Request) *Principal {
+	for _, fn := range authenticators {
+		if principal := fn(req); principal != nil {
+			return principal
+		}
+	}
+	return nil
+}
+
+func authBearer(req *http.Request) string {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+func authCurator(req *http.Request) *Principal {
+	token := authBearer(req)
+	if token == "" {
+		return nil
+	}
+
+	for _, curator := range Config.Auth.Curators {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(curator.Token)) != 1 {
+			continue
+		}
+
+		guilds := make(map[string]Perm)
+		for _, guild := range curator.Guilds {
+			guilds[guild] = PermRead | PermTag
+		}
+
+		return &Principal{
+			Actor: "curator:" + curator.Name,
+			perms: func(guild string) Perm { return guilds[guild] },
+		}
+	}
+
+	return nil
+}
+
+func authSession(req *http.Request) *Principal {
+	session := SessionGet(req)
+	if session == nil {
+		return nil
+	}
+
+	member := make(map[string]bool)
+	for _, guild := range session.Guilds {
+		member[guild] = true
+	}
+
+	return &Principal{
+		Actor: "user:" + session.UserId,
+		perms: func(guild string) Perm {
+			if !member[guild] {
+				return 0
+			}
+			return RolePerms(guild, session.UserId)
+		},
+	}
+}
+
+// Guilds are only public if they're explicitly configured as such. Without
+// a login mechanism there's no way to restrict reads so everything is public.
+func authPublic(guild string) bool {
+	if !OauthEnabled() {
+		return true
+	}
+
+	for _, public := range Config.Auth.Public {
+		if public == guild {
+			return true
+		}
+	}
+	return false
+}
+
+// Restricts a handler to the clients that can read the guild found at the
+// given index of the request path. Anonymous users are sent to the login page
+// when they request a page.
+func guard(index int, page bool, fn func(http.ResponseWriter, *http.Request) int) func(http.ResponseWriter, *http.Request) int {
+	return func(writer http.ResponseWriter, req *http.Request) int {
+		items := strings.Split(req.URL.Path, "/")
+		if len(items) <= index || items[index] == "" {
+			return respCode(http.StatusNotFound, writer, req)
+		}
+
+		guild := items[index]
+		if authPublic(guild) {
+			return fn(writer, req)
+		}
+
+		principal := authenticate(req)
+		if principal.Can(guild, PermRead) {
+			return fn(writer, req)
+		}
+
+		if principal != nil {
+			return respCode(http.StatusForbidden, writer, req)
+		}
+
+		if page {
+			next := url.QueryEscape(req.URL.RequestURI())
+			http.Redirect(writer, req, "/login?next="+next, http.StatusFound)
+			return http.StatusFound
+		}
+
+		return respCode(http.StatusUnauthorized, writer, req)
+	}
+}
+
+// Returns the principal of the request if it holds the permission on the
+// guild. Otherwise the error response is written and the status code is
+// returned.
+func authorize(guild string, perm Perm, writer http.ResponseWriter, req *http.Request) (*Principal, int) {
+	principal := authenticate(req)
+	if principal == nil {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		return nil, respCode(http.StatusUnauthorized, writer, req)
+	}
+
+	if !principal.Can(guild, perm) {
+		return nil, respCode(http.StatusForbidden, writer, req)
+	}
+
+	return principal, http.StatusOK
+}
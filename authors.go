@@ -0,0 +1,91 @@
+package main
+
+import "time"
+
+// Records archived before authors were tracked only carry the username their
+// author had at the time in their @ tag. Reconciling them requires fetching
+// their message again to find out who the author is.
+//
+// The reconciliation runs in the background on startup until every record is
+// attributed, or in the foreground with the -authors-reconcile flag. Progress
+// is checkpointed per guild such that a restart resumes where it left off.
+// Transient failures are retried with a backoff while the messages that can't
+// be read anymore are skipped.
+
+const authorsBatch = 100
+
+func AuthorsCommand() bool {
+	if !*authorsReconcile {
+		return false
+	}
+
+	AuthorsReconcile()
+	return true
+}
+
+func AuthorsStart() {
+	go AuthorsReconcile()
+}
+
+func AuthorsReconcile() {
+	for _, guild := range DatabaseSubGuilds() {
+		authorsReconcileGuild(guild)
+	}
+}
+
+func authorsReconcileGuild(guild string) {
+	checkpoint := "authors:" + guild
+	after := DatabaseCheckpoint(checkpoint)
+	count := 0
+
+	for {
+		records := DatabaseRecordsUnattributed(guild, after, authorsBatch)
+		if len(records) == 0 {
+			break
+		}
+
+		authors := make(map[string]*Author)
+		for _, rec := range records {
+			author, ok := authors[rec.MessageId]
+			if !ok {
+				author = authorsFetch(rec)
+				authors[rec.MessageId] = author
+			}
+
+			if author != nil {
+				DatabaseRecordAuthorSet(ActorScraper, guild, rec.Id, author)
+				count++
+			}
+			after = rec.Id
+		}
+
+		DatabaseCheckpointSet(checkpoint, after)
+	}
+
+	if count > 0 {
+		Info("authors reconciled for %v records of guild %v", count, guild)
+	}
+}
+
+// Returns the author of the record's message or nil if the message can't be
+// read anymore.
+func authorsFetch(rec *Record) *Author {
+	for attempt := 0; ; attempt++ {
+		msg, err := DiscordMessage(rec.ChannelId, rec.MessageId)
+		if err == nil {
+			return DiscordMessageAuthor(msg)
+		}
+
+		switch DiscordClassify(err) {
+		case DiscordErrRetry, DiscordErrAuth:
+			delay := superviseBackoff(attempt)
+			Warning("unable to fetch message '%v' of channel '%v', retrying in %v: %v",
+				rec.MessageId, rec.ChannelId, delay, err)
+			time.Sleep(delay)
+
+		default:
+			Warning("skipping message '%v' of channel '%v': %v", rec.MessageId, rec.ChannelId, err)
+			return nil
+		}
+	}
+}
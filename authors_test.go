@@ -0,0 +1,138 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestAuthorsReconcile(t *testing.T) {
+	testDatabase(t)
+	mux := testDiscord(t)
+
+	DatabaseSubSeed("1", "2")
+
+	// Alice is known by her nickname while bob was ingested under an older
+	// username. Another member also goes by Alice.
+	DatabaseAuthorUpdate(ActorScraper, "1", &Author{Id: "1001", Username: "alice99", Nickname: "Alice"})
+	DatabaseAuthorUpdate(ActorScraper, "1", &Author{Id: "1002", Username: "bob"})
+	DatabaseAuthorUpdate(ActorScraper, "1", &Author{Id: "1002", Username: "robert"})
+
+	users := map[string]*discordgo.User{
+		"1001": {ID: "1001", Username: "alice99"},
+		"1002": {ID: "1002", Username: "robert"},
+		"2003": {ID: "2003", Username: "Alice"},
+	}
+
+	// Messages keyed by id along with their author; the first fetch of m-flaky
+	// fails and unknown messages are reported as deleted.
+	messages := map[string]string{"m-a": "1001", "m-b": "1002", "m-flaky": "1002", "m-c": "2003"}
+	flaky := 1
+	mux.HandleFunc("/channels/2/messages/", func(writer http.ResponseWriter, req *http.Request) {
+		id := strings.TrimPrefix(req.URL.Path, "/channels/2/messages/")
+		if id == "m-flaky" && flaky > 0 {
+			flaky--
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		author, ok := messages[id]
+		if !ok {
+			writer.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(writer, `{"code": 10008, "message": "Unknown Message"}`)
+			return
+		}
+		json.NewEncoder(writer).Encode(&discordgo.Message{ID: id, Author: users[author]})
+	})
+
+	record := func(msg string, tags ...string) int64 {
+		return DatabaseRecordInsert(&Record{
+			GuildId:   "1",
+			ChannelId: "2",
+			MessageId: msg,
+			ImageId:   "img-" + msg,
+			Time:      time.Now(),
+			Path:      "https://i.imgur.com/" + msg + ".png",
+			Tags:      tags,
+		})
+	}
+
+	tests := []struct {
+		name   string
+		id     int64
+		author string
+		tags   []string
+	}{
+		{"mention first", record("m-a", "@bob", "@alice99"), "1001", []string{"@Alice", "@bob"}},
+		{"old username", record("m-b", "@bob", "#cats"), "1002", []string{"#cats", "@robert"}},
+		{"retried", record("m-flaky", "@robert"), "1002", []string{"@robert"}},
+		{"no match", record("m-c", "@bob"), "2003", []string{"@Alice~2003", "@bob"}},
+		{"deleted", record("m-gone", "@gone"), "", []string{"@gone"}},
+	}
+
+	AuthorsReconcile()
+
+	for _, test := range tests {
+		rec := DatabaseRecord("1", test.id)
+		if rec.AuthorId != test.author {
+			t.Errorf("%v: got author %q, expected %q", test.name, rec.AuthorId, test.author)
+		}
+		if !reflect.DeepEqual(rec.Tags, test.tags) {
+			t.Errorf("%v: got tags %q, expected %q", test.name, rec.Tags, test.tags)
+		}
+	}
+
+	if flaky != 0 {
+		t.Errorf("retried: expected the failed fetch to be retried")
+	}
+	if checkpoint := DatabaseCheckpoint("authors:1"); checkpoint != tests[len(tests)-1].id {
+		t.Errorf("checkpoint: got %v, expected %v", checkpoint, tests[len(tests)-1].id)
+	}
+
+	// Resumes after the checkpoint without fetching the skipped messages again.
+	messages["m-gone"] = "1001"
+	AuthorsReconcile()
+	if rec := DatabaseRecord("1", tests[len(tests)-1].id); rec.AuthorId != "" {
+		t.Errorf("resume: expected the skipped record to stay unattributed, got %q", rec.AuthorId)
+	}
+}
+
+func TestAuthorTagCollision(t *testing.T) {
+	testDatabase(t)
+
+	first := DatabaseAuthorUpdate(ActorScraper, "1", &Author{Id: "1001", Username: "alice"})
+	second := DatabaseAuthorUpdate(ActorScraper, "1", &Author{Id: "2002", Username: "bob", Nickname: "alice"})
+	other := DatabaseAuthorUpdate(ActorScraper, "2", &Author{Id: "2002", Username: "bob", Nickname: "alice"})
+
+	if first != "alice" || second != "alice~2002" || other != "alice" {
+		t.Errorf("got %q, %q and %q", first, second, other)
+	}
+
+	// Renaming away from the collision keeps the tags apart.
+	id := DatabaseRecordInsert(&Record{
+		GuildId:   "1",
+		ChannelId: "2",
+		MessageId: "3",
+		ImageId:   "4",
+		AuthorId:  "2002",
+		Time:      time.Now(),
+		Path:      "https://i.imgur.com/a.png",
+		Tags:      []string{"@alice~2002"},
+	})
+
+	if tag := DatabaseAuthorUpdate(ActorScraper, "1", &Author{Id: "2002", Username: "bob"}); tag != "bob" {
+		t.Errorf("rename: got %q", tag)
+	}
+	if tags := DatabaseRecord("1", id).Tags; !reflect.DeepEqual(tags, []string{"@bob"}) {
+		t.Errorf("rename: got tags %q", tags)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Chat commands that let the members allowed to manage a channel control its
+// archiving without access to the host. Guilds that map their roles to archive
+// permissions also require the admin permission:
+//
+//   !archive subscribe [#channel...] [--no-backfill]
+//   !archive unsubscribe [#channel...]
+//   !archive backfill [#channel...]
+//   !archive status
+//
+// Commands apply to the channel they're sent in when no channels are given.
+// The status only lists the channels the member is allowed to manage.
+
+const botPrefix = "!archive"
+
+var botChannelMention = regexp.MustCompile(`^<#(\d+)>$`)
+
+func BotInit() {
+	DiscordOnMessage(botMessage)
+}
+
+func botMessage(msg *Message) {
+	if msg.GuildID == "" || msg.Author == nil || msg.Author.Bot || DiscordIsSelf(msg.Author.ID) {
+		return
+	}
+
+	args := strings.Fields(msg.Content)
+	if len(args) == 0 || args[0] != botPrefix {
+		return
+	}
+
+	reply, err := botCommand(msg, args[1:])
+	if err != nil {
+		reply = "error: " + err.Error()
+	}
+
+	if err := DiscordSend(msg.ChannelID, reply); err != nil {
+		Warning("unable to reply to command '%v': %v", msg.ID, err)
+	}
+}
+
+func botCommand(msg *Message, args []string) (string, error) {
+	if len(args) == 0 {
+		return botUsage(), nil
+	}
+
+	cmd, args := args[0], args[1:]
+	if cmd == "status" {
+		return botStatus(msg), nil
+	}
+
+	options := SubOptions{}
+	channels := []string{}
+	for _, arg := range args {
+		if arg == "--no-backfill" && cmd == "subscribe" {
+			options.SkipBackfill = true
+		} else if match := botChannelMention.FindStringSubmatch(arg); match != nil {
+			channels = append(channels, match[1])
+		} else {
+			return "", fmt.Errorf("unknown argument '%v'", arg)
+		}
+	}
+	if len(channels) == 0 {
+		channels = append(channels, msg.ChannelID)
+	}
+
+	for _, channel := range channels {
+		if err := botAllowed(msg, channel); err != nil {
+			return "", err
+		}
+	}
+
+	Info("command guild:%v user:%v: %v %v", msg.GuildID, msg.Author.ID, cmd, args)
+
+	lines := []string{}
+	for _, channel := range channels {
+		switch cmd {
+		case "subscribe":
+			ScrapperSubscribe(msg.GuildID, channel, true, options)
+			lines = append(lines, fmt.Sprintf("archiving <#%v>", channel))
+
+		case "unsubscribe":
+			entry := botSub(msg.GuildID, channel)
+			if entry == nil || !entry.Enabled {
+				lines = append(lines, fmt.Sprintf("<#%v> isn't archived", channel))
+				continue
+			}
+			ScrapperSubscribe(msg.GuildID, channel, false, entry.Options)
+			lines = append(lines, fmt.Sprintf("stopped archiving <#%v>", channel))
+
+		case "backfill":
+			entry := botSub(msg.GuildID, channel)
+			if entry == nil || !entry.Enabled {
+				lines = append(lines, fmt.Sprintf("<#%v> isn't archived", channel))
+				continue
+			}
+
+			entry.Options.SkipBackfill = false
+			DatabaseSubSet(msg.GuildID, channel, true, entry.Options)
+			if !ScrapperBackfill(channel) {
+				lines = append(lines, fmt.Sprintf("<#%v> isn't running yet", channel))
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("backfilling <#%v>", channel))
+
+		default:
+			return botUsage(), nil
+		}
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+func botUsage() string {
+	return "usage: " + botPrefix + " subscribe|unsubscribe|backfill [#channel...] | status"
+}
+
+// Members must be able to manage the channels they change the archiving of and
+// must hold the admin permission if the guild maps its roles to permissions.
+func botCanManage(msg *Message, channel string) (bool, error) {
+	if RolesMapped(msg.GuildID) && RolePerms(msg.GuildID, msg.Author.ID)&PermAdmin == 0 {
+		return false, nil
+	}
+	return DiscordCanManageChannel(msg.Author.ID, channel)
+}
+
+func botAllowed(msg *Message, channel string) error {
+	info, err := DiscordChannel(channel)
+	if err != nil {
+		return fmt.Errorf("unknown channel <#%v>", channel)
+	}
+	if info.GuildId != msg.GuildID {
+		return fmt.Errorf("channel <#%v> isn't part of this server", channel)
+	}
+
+	ok, err := botCanManage(msg, channel)
+	if err != nil {
+		Warning("unable to fetch permissions of '%v' for '%v': %v", msg.Author.ID, channel, err)
+		return fmt.Errorf("unable to check permissions for <#%v>", channel)
+	}
+	if !ok {
+		return fmt.Errorf("permission to manage <#%v> required", channel)
+	}
+
+	return nil
+}
+
+func botSub(guild, channel string) *Subscription {
+	for _, entry := range DatabaseSubs() {
+		if entry.Guild == guild && entry.Channel == channel {
+			return entry
+		}
+	}
+	return nil
+}
+
+func botStatus(msg *Message) string {
+	position := func(id string) string {
+		if id == "" {
+			return "none"
+		}
+		ts, err := DiscordTimestamp(id)
+		if err != nil {
+			return id
+		}
+		return ts.UTC().Format(time.RFC3339)
+	}
+
+	lines := []string{}
+	for _, entry := range DatabaseSubs() {
+		if entry.Guild != msg.GuildID {
+			continue
+		}
+
+		if ok, err := botCanManage(msg, entry.Channel); err != nil || !ok {
+			continue
+		}
+
+		state := "disabled"
+		if entry.Enabled && entry.State != SubHealthy {
+			state = entry.State + " (" + entry.Error + ")"
+		} else if entry.Enabled && ScrapperRunning(entry.Channel) {
+			state = "running"
+		} else if entry.Enabled {
+			state = "pending"
+		}
+
+		lines = append(lines, fmt.Sprintf("<#%v>: %v, latest %v, earliest %v",
+			entry.Channel, state, position(entry.Latest), position(entry.Earliest)))
+	}
+
+	if len(lines) == 0 {
+		return "no archived channels"
+	}
+	return strings.Join(lines, "\n")
+}
@@ -2,8 +2,9 @@
 set -o errexit -o nounset -o pipefail
 
 go fmt ./...
-go build -mod=vendor ./...
-go vet ./...
+go build -mod=vendor -tags sqlite_fts5 ./...
+go vet -tags sqlite_fts5 ./...
+go test -tags sqlite_fts5 ./...
 
 rm -rf /tmp/archivist
 mkdir -p /tmp/archivist/usr/local/bin
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Discord signs its CDN attachment urls with an expiry timestamp after which
+// the CDN refuses to serve them. Fresh urls are fetched on demand when a
+// record is requested and cached in the database until they expire.
+
+// Refresh urls a bit before they expire to account for clock skew and for the
+// time it takes the client to follow the redirect.
+const cdnMargin = 5 * time.Minute
+
+var (
+	errCdnGone   = errors.New("attachment no longer exists")
+	errCdnLinked = errors.New("expired url is still linked")
+)
+
+// Returns the expiry of a signed CDN url which is stored as a hex unix
+// timestamp in the 'ex' query parameter.
+func cdnExpiry(raw string) (bool, time.Time) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return false, time.Time{}
+	}
+
+	ex := parsed.Query().Get("ex")
+	if ex == "" {
+		return false, time.Time{}
+	}
+
+	ts, err := strconv.ParseInt(ex, 16, 64)
+	if err != nil {
+		return false, time.Time{}
+	}
+
+	return true, time.Unix(ts, 0)
+}
+
+// Discord no longer serves the unsigned urls of its attachments so they are
+// treated as expired while the urls of other hosts never expire.
+func cdnDiscordHost(raw string) bool {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+
+	host := parsed.Hostname()
+	return host == "cdn.discordapp.com" || host == "media.discordapp.net"
+}
+
+func cdnValid(raw string) bool {
+	signed, expires := cdnExpiry(raw)
+	if !signed {
+		return !cdnDiscordHost(raw)
+	}
+	return time.Now().Add(cdnMargin).Before(expires)
+}
+
+func cdnRefresh(rec *Record) (string, error) {
+	urls, err := DiscordRefreshUrls([]string{rec.Path})
+	if err == nil {
+		if fresh, ok := urls[rec.Path]; ok && fresh != "" {
+			return fresh, nil
+		}
+	} else {
+		Warning("unable to refresh url for '%v': %v", rec.Id, err)
+	}
+
+	// Only attachments can be looked up again through their message so the
+	// other images are only gone if Discord no longer knows about their url
+	// and none of the messages sharing the image still link it.
+	if rec.Source != SourceAttachment {
+		if err != nil {
+			return "", err
+		}
+
+		linked, err := cdnLinked(rec)
+		if err != nil {
+			return "", err
+		} else if linked {
+			return "", errCdnLinked
+		}
+		return "", errCdnGone
+	}
+
+	fresh, err := DiscordAttachmentUrl(rec.ChannelId, rec.MessageId, rec.ImageId)
+	if DiscordIsGone(err) || (err == nil && fresh == "") {
+		return "", errCdnGone
+	}
+	return fresh, err
+}
+
+// Checks whether any of the messages linking the image of a record still link
+// it. The messages that were deleted or no longer link the image are detached
+// from the record along the way.
+func cdnLinked(rec *Record) (bool, error) {
+	for _, link := range DatabaseRecordLinks(rec.Id) {
+		msg, err := DiscordMessageReload(link[0], link[1])
+		if err != nil && !DiscordIsGone(err) {
+			return false, err
+		}
+
+		if err == nil {
+			for _, img := range images(rec.GuildId, msg) {
+				if img.id == rec.ImageId {
+					return true, nil
+				}
+			}
+		}
+
+		DatabaseRecordUnlink(ActorCdn, rec.Id, link[1])
+	}
+	return false, nil
+}
+
+// Returns a url to the record's image that is valid for at least a little
+// while. Returns errCdnGone if the image was removed from Discord.
+func CdnUrl(rec *Record) (string, error) {
+	if cdnValid(rec.Path) {
+		return rec.Path, nil
+	}
+
+	if cached := DatabaseUrl(rec.Id); cached != "" && cdnValid(cached) {
+		return cached, nil
+	}
+
+	fresh, err := cdnRefresh(rec)
+	if err != nil {
+		return "", err
+	}
+
+	_, expires := cdnExpiry(fresh)
+	DatabaseUrlSet(rec.Id, fresh, expires)
+
+	Info("refresh %v -> img:%v expires:%v", rec.Id, rec.ImageId, expires)
+	return fresh, nil
+}
@@ -0,0 +1,173 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func cdnTestUrl(name string, expires time.Time) string {
+	return fmt.Sprintf("https://cdn.discordapp.com/attachments/2/%v?ex=%x", name, expires.Unix())
+}
+
+func TestCdnUrl(t *testing.T) {
+	testDatabase(t)
+	mux := testDiscord(t)
+
+	expired := time.Now().Add(-time.Hour)
+	fresh := time.Now().Add(24 * time.Hour)
+
+	// Urls missing from refreshed are omitted from the response as Discord
+	// does for the attachments it no longer knows about.
+	refreshed := map[string]string{}
+	refreshFail := false
+	refreshCalls := 0
+	mux.HandleFunc("/attachments/refresh-urls", func(writer http.ResponseWriter, req *http.Request) {
+		refreshCalls++
+		if refreshFail {
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		body := struct {
+			Urls []string `json:"attachment_urls"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Error(err)
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		type entry struct {
+			Original  string `json:"original"`
+			Refreshed string `json:"refreshed"`
+		}
+		resp := struct {
+			Urls []entry `json:"refreshed_urls"`
+		}{}
+		for _, url := range body.Urls {
+			if fresh, ok := refreshed[url]; ok {
+				resp.Urls = append(resp.Urls, entry{url, fresh})
+			}
+		}
+		json.NewEncoder(writer).Encode(resp)
+	})
+
+	// Messages keyed by id; unknown messages are reported as deleted.
+	messages := map[string]*discordgo.Message{}
+	mux.HandleFunc("/channels/2/messages/", func(writer http.ResponseWriter, req *http.Request) {
+		msg, ok := messages[strings.TrimPrefix(req.URL.Path, "/channels/2/messages/")]
+		if !ok {
+			writer.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(writer, `{"code": 10008, "message": "Unknown Message"}`)
+			return
+		}
+		json.NewEncoder(writer).Encode(msg)
+	})
+
+	record := func(img, source, path string) *Record {
+		rec := &Record{
+			GuildId:   "1",
+			ChannelId: "2",
+			MessageId: "m-" + img,
+			ImageId:   img,
+			Source:    source,
+			Time:      time.Now(),
+			Path:      path,
+		}
+		rec.Id = DatabaseRecordInsert(rec)
+		return rec
+	}
+
+	unsigned := record("a", SourceEmbed, "https://i.imgur.com/a.png")
+	valid := record("b", SourceAttachment, cdnTestUrl("b.png", fresh))
+	refreshable := record("c", SourceAttachment, cdnTestUrl("c.png", expired))
+	refreshed[refreshable.Path] = cdnTestUrl("c-fresh.png", fresh)
+	reattached := record("d", SourceAttachment, cdnTestUrl("d.png", expired))
+	messages[reattached.MessageId] = &discordgo.Message{
+		Attachments: []*discordgo.MessageAttachment{{ID: "d", URL: cdnTestUrl("d-fresh.png", fresh)}},
+	}
+	deleted := record("e", SourceAttachment, cdnTestUrl("e.png", expired))
+	detached := record("f", SourceAttachment, cdnTestUrl("f.png", expired))
+	messages[detached.MessageId] = &discordgo.Message{}
+	embedded := record("g", SourceEmbed, cdnTestUrl("g.png", expired))
+	legacy := record("i", SourceAttachment, "https://cdn.discordapp.com/attachments/2/i.png")
+	refreshed[legacy.Path] = cdnTestUrl("i-fresh.png", fresh)
+
+	tests := []struct {
+		name string
+		rec  *Record
+		url  string
+		err  error
+	}{
+		{"unsigned", unsigned, unsigned.Path, nil},
+		{"valid", valid, valid.Path, nil},
+		{"refreshed", refreshable, refreshed[refreshable.Path], nil},
+		{"reattached", reattached, messages[reattached.MessageId].Attachments[0].URL, nil},
+		{"deleted message", deleted, "", errCdnGone},
+		{"deleted attachment", detached, "", errCdnGone},
+		{"unknown embed", embedded, "", errCdnGone},
+		{"legacy unsigned", legacy, refreshed[legacy.Path], nil},
+	}
+
+	for _, test := range tests {
+		url, err := CdnUrl(test.rec)
+		if url != test.url || err != test.err {
+			t.Errorf("%v: got (%q, %v), expected (%q, %v)", test.name, url, err, test.url, test.err)
+		}
+	}
+
+	// An embedded image shared by several messages is only gone once none of
+	// them link it anymore, deleting its first message doesn't tombstone it.
+	sharedUrl := cdnTestUrl("h.png", expired)
+	shared := record(imageId("1", sharedUrl), SourceEmbed, sharedUrl)
+	DatabaseRecordInsert(&Record{
+		GuildId:   "1",
+		ChannelId: "2",
+		MessageId: "m-h2",
+		ImageId:   shared.ImageId,
+		Source:    SourceLink,
+		Time:      time.Now(),
+		Path:      sharedUrl,
+	})
+	messages["m-h2"] = &discordgo.Message{Content: "look " + sharedUrl}
+
+	DatabaseRecordDelete(ActorScraper, shared.MessageId)
+	if rec := DatabaseRecord("1", shared.Id); rec == nil || rec.Deleted || rec.MessageId != "m-h2" {
+		t.Errorf("shared: expected the record to move to the other message, got %+v", rec)
+	}
+	if url, err := CdnUrl(shared); err != errCdnLinked {
+		t.Errorf("shared: got (%q, %v), expected %v", url, err, errCdnLinked)
+	}
+
+	delete(messages, "m-h2")
+	if url, err := CdnUrl(shared); err != errCdnGone {
+		t.Errorf("unlinked: got (%q, %v), expected %v", url, err, errCdnGone)
+	}
+	if links := DatabaseRecordLinks(shared.Id); len(links) != 0 {
+		t.Errorf("unlinked: expected no links, got %v", links)
+	}
+
+	// Refreshed urls are cached until they expire.
+	refreshCalls = 0
+	if url, err := CdnUrl(refreshable); err != nil || url != refreshed[refreshable.Path] {
+		t.Errorf("cached: got (%q, %v)", url, err)
+	}
+	if refreshCalls != 0 {
+		t.Errorf("cached: expected no refresh, got %v", refreshCalls)
+	}
+
+	// A failing refresh isn't proof that an embedded image is gone.
+	refreshFail = true
+	if url, err := CdnUrl(embedded); err == nil || err == errCdnGone {
+		t.Errorf("failed refresh: got (%q, %v), expected a transient error", url, err)
+	}
+}
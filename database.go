@@ -2,8 +2,10 @@ package main
 
 import (
 	"database/sql"
-	"os"
+	"encoding/json"
+	"strings"
 	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -13,37 +15,28 @@ var (
 	lock sync.RWMutex
 )
 
-var schema = []string{`
-create table records (
-    id integer not null primary key autoincrement,
-    guild_id text not null,
-    chan_id text not null,
-    msg_id text not null,
-    img_id text not null,
-    time datetime not null,
-    path text not null,
-    caption text
-);`, `
-create unique index index_records_img on records(img_id);
-`, `
-create index index_records_msg on records(msg_id);
-`, `
-create index index_records_time on records(time);
-`, `
-create table tags(
-    record_id integer not null references records(id),
-    tag text not null,
-    constraint pk primary key (record_id, tag)
-);`, `
-create index index_tags_record on tags(record_id);
-`, `
-create index index_tags_tag on tags(tag);
-`, `
-create table subs (
-    chan_id text not null primary key,
-    earliest_msg_id text not null,
-    latest_msg_id text not null
-);`,
+const recordColumns = "id, guild_id, chan_id, msg_id, img_id, source, time, path, caption," +
+	" coalesce(author_id, ''), coalesce(filename, '')," +
+	" coalesce(width, 0), coalesce(height, 0), coalesce(size, 0)"
+
+// Scan destinations matching recordColumns.
+func recordFields(rec *Record) []interface{} {
+	return []interface{}{
+		&rec.Id,
+		&rec.GuildId,
+		&rec.ChannelId,
+		&rec.MessageId,
+		&rec.ImageId,
+		&rec.Source,
+		&rec.Time,
+		&rec.Path,
+		&rec.Caption,
+		&rec.AuthorId,
+		&rec.Filename,
+		&rec.Width,
+		&rec.Height,
+		&rec.Size,
+	}
 }
 
 func check(err error, query string) {
@@ -52,105 +45,247 @@ func check(err error, query string) {
 	}
 }
 
-func DatabaseOpen(file string) {
-	init := false
-	if _, err := os.Stat(file); err != nil {
-		init = true
+// Rebuilds the search index entries of the records matching the given column.
+// Must be called within the transaction that modified the records.
+func ftsSync(tx *sql.Tx, column string, value interface{}) {
+	{
+		query := "delete from records_fts where rowid in (select id from records where " + column + " = ?);"
+		_, err := tx.Exec(query, value)
+		check(err, query)
+	}
+
+	{
+		query := "insert into records_fts(rowid, caption, tags)" +
+			"  select id, coalesce(caption, '')," +
+			"    coalesce((select group_concat(tag, ' ') from tags where record_id = records.id), '')" +
+			"  from records where " + column + " = ?;"
+		_, err := tx.Exec(query, value)
+		check(err, query)
+	}
+}
+
+// Returns the ids and image ids of the live records matching the given column.
+func txRecordsBy(tx *sql.Tx, column string, value interface{}) map[int64]string {
+	query := "select id, img_id from records where " + column + " = ? and deleted is null;"
+	rows, err := tx.Query(query, value)
+	defer rows.Close()
+	check(err, query)
+
+	records := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var img string
+		check(rows.Scan(&id, &img), query)
+		records[id] = img
+	}
+	return records
+}
+
+func DatabaseOpen(file string, readOnly bool) {
+	mode := "rwc"
+	if readOnly {
+		mode = "ro"
 	}
 
 	var err error
-	db, err = sql.Open("sqlite3", "file:"+file+"?mode=rwc")
+	db, err = sql.Open("sqlite3", "file:"+file+"?mode="+mode)
 	if err != nil {
 		Fatal("unable to open '%v': %v", file, err)
 	}
-
-	if init {
-		for _, query := range schema {
-			if _, err := db.Exec(query); err != nil {
-				Fatal("unable to initialize db '%v': %v\n%v", file, err, query)
-			}
-		}
-	}
 }
 
 func DatabaseClose() {
 	db.Close()
 }
 
-func DatabaseSub(channel string) (string, string) {
+func DatabaseSubs() []*Subscription {
 	lock.RLock()
 	defer lock.RUnlock()
 
-	const query = "select earliest_msg_id, latest_msg_id from subs where chan_id = ?;"
-	rows, err := db.Query(query, channel)
+	const query = "select guild_id, chan_id, enabled, options, earliest_msg_id, latest_msg_id," +
+		"    state, coalesce(error, '')" +
+		"  from subs where guild_id is not null;"
+	rows, err := db.Query(query)
 	defer rows.Close()
 	check(err, query)
 
-	if !rows.Next() {
-		const query = "insert into subs (chan_id, earliest_msg_id, latest_msg_id) values (?, \"\", \"\");"
-		_, err := db.Exec(query, channel)
-		check(err, query)
-		return "", ""
+	subs := []*Subscription{}
+	for rows.Next() {
+		sub := &Subscription{}
+		var options string
+		check(rows.Scan(
+			&sub.Guild,
+			&sub.Channel,
+			&sub.Enabled,
+			&options,
+			&sub.Earliest,
+			&sub.Latest,
+			&sub.State,
+			&sub.Error), query)
+
+		if err := json.Unmarshal([]byte(options), &sub.Options); err != nil {
+			Warning("invalid options for sub '%v': %v", sub.Channel, err)
+		}
+		subs = append(subs, sub)
 	}
+	return subs
+}
 
-	var earliest, latest string
-	check(rows.Scan(&earliest, &latest), query)
-	return earliest, latest
+// Adds a sub if it doesn't already exist. Existing subs are only completed with
+// their guild which predates the subs being managed in the database.
+func DatabaseSubSeed(guild, channel string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	const query = "insert into subs(chan_id, guild_id, earliest_msg_id, latest_msg_id)" +
+		"  values(?, ?, '', '')" +
+		"  on conflict(chan_id) do update set guild_id = coalesce(guild_id, excluded.guild_id);"
+	_, err := db.Exec(query, channel, guild)
+	check(err, query)
 }
 
-func DatabaseSubUpdateLatest(channel, pos string) {
+// Creates or updates a sub, keeping the progress of existing subs. Clears the
+// state of the sub which gives paused subs a fresh start.
+func DatabaseSubSet(guild, channel string, enabled bool, options SubOptions) {
 	lock.Lock()
 	defer lock.Unlock()
 
-	const query = "update subs set latest_msg_id = ? where chan_id = ?;"
-	_, err := db.Exec(query, pos, channel)
+	raw, err := json.Marshal(options)
+	check(err, "marshal")
+
+	const query = "insert into subs(chan_id, guild_id, enabled, options, earliest_msg_id, latest_msg_id)" +
+		"  values(?, ?, ?, ?, '', '')" +
+		"  on conflict(chan_id) do update set" +
+		"    guild_id = excluded.guild_id, enabled = excluded.enabled, options = excluded.options," +
+		"    state = '', error = null, state_time = null;"
+	_, err = db.Exec(query, channel, guild, enabled, string(raw))
 	check(err, query)
 }
 
-func DatabaseSubUpdateEarliest(channel, pos string) {
+func DatabaseSubState(channel, state, err string) {
 	lock.Lock()
 	defer lock.Unlock()
 
-	const query = "update subs set earliest_msg_id = ? where chan_id = ?;"
+	const query = "update subs set state = ?, error = nullif(?, ''), state_time = ? where chan_id = ?;"
+	_, dbErr := db.Exec(query, state, err, time.Now(), channel)
+	check(dbErr, query)
+}
+
+// Guilds with at least one sub, enabled or not, as their archive remains
+// available either way.
+func DatabaseSubGuilds() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	const query = "select distinct guild_id from subs where guild_id is not null;"
+	rows, err := db.Query(query)
+	defer rows.Close()
+	check(err, query)
+
+	guilds := []string{}
+	for rows.Next() {
+		var guild string
+		check(rows.Scan(&guild), query)
+		guilds = append(guilds, guild)
+	}
+	return guilds
+}
+
+// Checkpoints of the subs which mark the range of messages already archived.
+const (
+	SubLatest   = "latest"
+	SubEarliest = "earliest"
+)
+
+func DatabaseSubUpdateLatest(channel, pos string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	const query = "update subs set latest_msg_id = ? where chan_id = ?;"
 	_, err := db.Exec(query, pos, channel)
 	check(err, query)
 }
 
-func DatabaseRecordInsert(rec *Record) int64 {
+// Returns the value of a checkpoint or 0 if it was never set.
+func DatabaseCheckpoint(name string) int64 {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	const query = "select value from checkpoints where name = ?;"
+	rows, err := db.Query(query, name)
+	defer rows.Close()
+	check(err, query)
+
+	var value int64
+	if rows.Next() {
+		check(rows.Scan(&value), query)
+	}
+	return value
+}
+
+func DatabaseCheckpointSet(name string, value int64) {
 	lock.Lock()
 	defer lock.Unlock()
 
-	tx, err := db.Begin()
-	check(err, "begin")
+	const query = "insert into checkpoints(name, value) values(?, ?)" +
+		"  on conflict(name) do update set value = excluded.value;"
+	_, err := db.Exec(query, name, value)
+	check(err, query)
+}
 
+// Tags are only added to new records such that the tags removed from an archived
+// record aren't brought back when its message is scraped again. Reactions are
+// only taken from the message of the record as an image linked again in another
+// message is deduplicated into the existing record. They replace the reactions
+// of the record such that the emojis removed from the message are dropped,
+// unless they're nil in which case the record's reactions are left alone.
+func txRecordInsert(tx *sql.Tx, rec *Record) int64 {
+	source := rec.Source
+	if source == "" {
+		source = SourceAttachment
+	}
+
+	var inserted bool
 	{
-		const query = "insert into records(guild_id, chan_id, msg_id, img_id, time, path, caption)" +
-			"  values(?, ?, ?, ?, ?, ?, ?) on conflict do nothing;"
-		_, err := tx.Exec(
+		const query = "insert into records(guild_id, chan_id, msg_id, img_id, source, time, path, caption," +
+			"    author_id, filename, width, height, size)" +
+			"  values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) on conflict do nothing;"
+		result, err := tx.Exec(
 			query,
 			rec.GuildId,
 			rec.ChannelId,
 			rec.MessageId,
 			rec.ImageId,
+			source,
 			rec.Time,
 			rec.Path,
-			rec.Caption)
+			rec.Caption,
+			rec.AuthorId,
+			rec.Filename,
+			rec.Width,
+			rec.Height,
+			rec.Size)
 		check(err, query)
+
+		count, err := result.RowsAffected()
+		check(err, query)
+		inserted = count > 0
 	}
 
 	// result.LastInsertId() is unreliable in the case of an upsert so can't use it.
 	var id int64
+	var msg string
 	{
-		const query = "select id from records where img_id = ?;"
+		const query = "select id, msg_id from records where img_id = ?;"
 		rows, err := tx.Query(query, rec.ImageId)
 
 		if !rows.Next() {
 			Fatal("unable to get id of upserted record '%v': %v", rec.ImageId, err)
 		}
-		check(rows.Scan(&id), query)
+		check(rows.Scan(&id, &msg), query)
 	}
 
-	{
+	if inserted {
 		const query = "insert into tags(record_id, tag) values(?, ?) on conflict do nothing;"
 		for _, tag := range rec.Tags {
 			_, err := tx.Exec(query, id, tag)
@@ -158,10 +293,234 @@ func DatabaseRecordInsert(rec *Record) int64 {
 		}
 	}
 
+	if source != SourceAttachment {
+		const query = "insert into links(record_id, chan_id, msg_id) values(?, ?, ?) on conflict do nothing;"
+		_, err := tx.Exec(query, id, rec.ChannelId, rec.MessageId)
+		check(err, query)
+	}
+
+	if rec.Reactions != nil && (inserted || msg == rec.MessageId) {
+		{
+			const query = "delete from reactions where record_id = ?;"
+			_, err := tx.Exec(query, id)
+			check(err, query)
+		}
+
+		const query = "insert into reactions(record_id, emoji, count) values(?, ?, ?);"
+		for emoji, count := range rec.Reactions {
+			_, err := tx.Exec(query, id, emoji, count)
+			check(err, query)
+		}
+		txPopularity(tx, id)
+	}
+
+	ftsSync(tx, "id", id)
+	return id
+}
+
+func DatabaseRecordInsert(rec *Record) int64 {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	id := txRecordInsert(tx, rec)
+
 	check(tx.Commit(), "commit")
 	return id
 }
 
+// Inserts the records of a page of messages and moves the checkpoint of the sub
+// to the last message of the page within the same transaction such that a
+// restart resumes right after the archived messages. The authors seen in the
+// page are recorded along the way. Returns the ids of the records in the order
+// they were given.
+func DatabaseRecordsInsertPage(guild string, authors []*Author, recs []*Record, channel, checkpoint, pos string) []int64 {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	for _, author := range authors {
+		txAuthorSeen(tx, guild, author)
+	}
+
+	ids := []int64{}
+	for _, rec := range recs {
+		ids = append(ids, txRecordInsert(tx, rec))
+	}
+
+	var query string
+	switch checkpoint {
+	case SubLatest:
+		query = "update subs set latest_msg_id = ? where chan_id = ?;"
+	case SubEarliest:
+		query = "update subs set earliest_msg_id = ? where chan_id = ?;"
+	default:
+		Fatal("unknown sub checkpoint '%v'", checkpoint)
+	}
+	_, err = tx.Exec(query, pos, channel)
+	check(err, query)
+
+	check(tx.Commit(), "commit")
+	return ids
+}
+
+// Returns the ids and image ids of the live records of a message along with the
+// records of images deduplicated from other messages that the message links.
+func txRecordsLinked(tx *sql.Tx, msg string) map[int64]string {
+	records := txRecordsBy(tx, "msg_id", msg)
+
+	const query = "select id, img_id from records" +
+		"  where id in (select record_id from links where msg_id = ?) and deleted is null;"
+	rows, err := tx.Query(query, msg)
+	defer rows.Close()
+	check(err, query)
+
+	for rows.Next() {
+		var id int64
+		var img string
+		check(rows.Scan(&id, &img), query)
+		records[id] = img
+	}
+	return records
+}
+
+// Removes a message from the messages linking the image of a record and only
+// tombstones the record once no message links it anymore. The record is moved
+// to one of the remaining messages if it was attributed to the removed one.
+func txRecordDetach(tx *sql.Tx, actor string, id int64, msg string) {
+	{
+		const query = "delete from links where record_id = ? and msg_id = ?;"
+		_, err := tx.Exec(query, id, msg)
+		check(err, query)
+	}
+
+	var channel, other string
+	{
+		const query = "select chan_id, msg_id from links where record_id = ? order by msg_id asc limit 1;"
+		rows, err := tx.Query(query, id)
+		defer rows.Close()
+		check(err, query)
+
+		if !rows.Next() {
+			txRecordDelete(tx, actor, id, true)
+			return
+		}
+		check(rows.Scan(&channel, &other), query)
+	}
+
+	const query = "update records set chan_id = ?, msg_id = ? where id = ? and msg_id = ?;"
+	_, err := tx.Exec(query, channel, other, id, msg)
+	check(err, query)
+}
+
+// Updates the caption of all the records of a message and detaches the records
+// whose image is no longer in the message. A nil images slice leaves the
+// records untouched.
+func DatabaseRecordUpdate(actor, msg, caption string, tags, images []string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	for id := range txRecordsBy(tx, "msg_id", msg) {
+		txRecordCaption(tx, actor, id, caption)
+		if len(tags) > 0 {
+			txTagsSet(tx, actor, id, tags)
+		}
+	}
+
+	if images != nil {
+		for id, img := range txRecordsLinked(tx, msg) {
+			attached := false
+			for _, image := range images {
+				attached = attached || image == img
+			}
+			if !attached {
+				txRecordDetach(tx, actor, id, msg)
+			}
+		}
+	}
+
+	check(tx.Commit(), "commit")
+}
+
+func DatabaseRecordDelete(actor, msg string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	for id := range txRecordsLinked(tx, msg) {
+		txRecordDetach(tx, actor, id, msg)
+	}
+
+	check(tx.Commit(), "commit")
+}
+
+// Returns the channel and message ids of the messages linking the image of a
+// record that wasn't attached to its message.
+func DatabaseRecordLinks(id int64) [][2]string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	const query = "select chan_id, msg_id from links where record_id = ? order by msg_id asc;"
+	rows, err := db.Query(query, id)
+	defer rows.Close()
+	check(err, query)
+
+	links := [][2]string{}
+	for rows.Next() {
+		var link [2]string
+		check(rows.Scan(&link[0], &link[1]), query)
+		links = append(links, link)
+	}
+	return links
+}
+
+func DatabaseRecordUnlink(actor string, id int64, msg string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	txRecordDetach(tx, actor, id, msg)
+
+	check(tx.Commit(), "commit")
+}
+
+func DatabaseRecordDeleteImage(actor, img string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	for id := range txRecordsBy(tx, "img_id", img) {
+		txRecordDelete(tx, actor, id, true)
+	}
+
+	check(tx.Commit(), "commit")
+}
+
+func DatabaseRecordHide(actor string, id int64, hidden bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	txRecordHide(tx, actor, id, hidden)
+
+	check(tx.Commit(), "commit")
+}
+
 func DatabaseRecord(guild string, id int64) *Record {
 	lock.RLock()
 	defer lock.RUnlock()
@@ -172,25 +531,18 @@ func DatabaseRecord(guild string, id int64) *Record {
 	rec := &Record{}
 
 	{
-		const query = "select id, guild_id, chan_id, msg_id, img_id, time, path, caption" +
+		const query = "select " + recordColumns + ", deleted is not null, hidden is not null" +
 			"  from records where id = ? and guild_id = ?;"
 		rows, err := tx.Query(query, id, guild)
 		defer rows.Close()
 		check(err, query)
 
 		if !rows.Next() {
+			check(tx.Rollback(), "rollback")
 			return nil
 		}
 
-		check(rows.Scan(
-			&rec.Id,
-			&rec.GuildId,
-			&rec.ChannelId,
-			&rec.MessageId,
-			&rec.ImageId,
-			&rec.Time,
-			&rec.Path,
-			&rec.Caption), query)
+		check(rows.Scan(append(recordFields(rec), &rec.Deleted, &rec.Hidden)...), query)
 	}
 
 	{
@@ -206,17 +558,248 @@ func DatabaseRecord(guild string, id int64) *Record {
 		}
 	}
 
+	{
+		const query = "select emoji, count from reactions where record_id = ?;"
+		rows, err := tx.Query(query, rec.Id)
+		defer rows.Close()
+		check(err, query)
+
+		for rows.Next() {
+			var emoji string
+			var count int
+			check(rows.Scan(&emoji, &count), query)
+			if rec.Reactions == nil {
+				rec.Reactions = make(map[string]int)
+			}
+			rec.Reactions[emoji] = count
+		}
+	}
+
 	check(tx.Commit(), "commit")
 	return rec
 }
 
+// Keeps the reaction total of a record, which is used to sort by popularity, in
+// sync with its reactions.
+func txPopularity(tx *sql.Tx, id int64) {
+	const query = "update records set popularity =" +
+		"  (select coalesce(sum(count), 0) from reactions where record_id = ?)" +
+		"  where id = ?;"
+	_, err := tx.Exec(query, id, id)
+	check(err, query)
+}
+
+// Adjusts the count of an emoji on all the live records of a message and adds
+// the given tag, if any, when the emoji is added. Tags are left alone when
+// reactions are removed as they may have been set by hand since, and tags
+// removed by hand aren't brought back by new reactions.
+func DatabaseReactionAdd(actor, msg, emoji string, delta int, tag string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	for id := range txRecordsBy(tx, "msg_id", msg) {
+		{
+			const query = "insert into reactions(record_id, emoji, count) values(?, ?, ?)" +
+				"  on conflict(record_id, emoji) do update set count = count + excluded.count;"
+			_, err := tx.Exec(query, id, emoji, delta)
+			check(err, query)
+		}
+
+		{
+			const query = "delete from reactions where record_id = ? and count <= 0;"
+			_, err := tx.Exec(query, id)
+			check(err, query)
+		}
+
+		txPopularity(tx, id)
+
+		if tag != "" && delta > 0 {
+			txTagsSetAuto(tx, actor, id, []string{tag})
+		}
+	}
+
+	check(tx.Commit(), "commit")
+}
+
+func DatabaseReactionsClear(msg string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	for id := range txRecordsBy(tx, "msg_id", msg) {
+		const query = "delete from reactions where record_id = ?;"
+		_, err := tx.Exec(query, id)
+		check(err, query)
+
+		txPopularity(tx, id)
+	}
+
+	check(tx.Commit(), "commit")
+}
+
+func DatabaseUrl(id int64) string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	const query = "select url from urls where record_id = ?;"
+	rows, err := db.Query(query, id)
+	defer rows.Close()
+	check(err, query)
+
+	if !rows.Next() {
+		return ""
+	}
+
+	var url string
+	check(rows.Scan(&url), query)
+	return url
+}
+
+func DatabaseUrlSet(id int64, url string, expires time.Time) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	const query = "insert into urls(record_id, url, expires) values(?, ?, ?)" +
+		"  on conflict(record_id) do update set url = excluded.url, expires = excluded.expires;"
+	_, err := db.Exec(query, id, url, expires)
+	check(err, query)
+}
+
+// Fetches multiple records along with their tags in a fixed number of queries.
+// Records are returned in the order of the given ids and the ids that don't
+// match a live record of the guild are omitted.
+// SQLite refuses queries with more than 999 variables so large batches are
+// fetched in chunks.
+const databaseBatchSize = 500
+
+func DatabaseRecordsBatch(guild string, ids []int64) []*Record {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	records := []*Record{}
+	if len(ids) == 0 {
+		return records
+	}
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	index := make(map[int64]*Record)
+	for start := 0; start < len(ids); start += databaseBatchSize {
+		end := start + databaseBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		txRecordsBatch(tx, guild, ids[start:end], index)
+	}
+
+	check(tx.Commit(), "commit")
+
+	for _, id := range ids {
+		if rec, ok := index[id]; ok {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+func txRecordsBatch(tx *sql.Tx, guild string, ids []int64, index map[int64]*Record) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	args := []interface{}{guild}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	{
+		query := "select " + recordColumns +
+			"  from records where guild_id = ? and deleted is null and hidden is null" +
+			"  and id in (" + placeholders + ");"
+		rows, err := tx.Query(query, args...)
+		defer rows.Close()
+		check(err, query)
+
+		for rows.Next() {
+			rec := &Record{Tags: []string{}}
+			check(rows.Scan(recordFields(rec)...), query)
+			index[rec.Id] = rec
+		}
+	}
+
+	{
+		query := "select record_id, tag from tags" +
+			"  where record_id in (" + placeholders + ")" +
+			"  order by tag asc;"
+		rows, err := tx.Query(query, args[1:]...)
+		defer rows.Close()
+		check(err, query)
+
+		for rows.Next() {
+			var id int64
+			var tag string
+			check(rows.Scan(&id, &tag), query)
+			if rec, ok := index[id]; ok {
+				rec.Tags = append(rec.Tags, tag)
+			}
+		}
+	}
+
+	{
+		query := "select record_id, emoji, count from reactions" +
+			"  where record_id in (" + placeholders + ");"
+		rows, err := tx.Query(query, args[1:]...)
+		defer rows.Close()
+		check(err, query)
+
+		for rows.Next() {
+			var id int64
+			var emoji string
+			var count int
+			check(rows.Scan(&id, &emoji, &count), query)
+			if rec, ok := index[id]; ok {
+				if rec.Reactions == nil {
+					rec.Reactions = make(map[string]int)
+				}
+				rec.Reactions[emoji] = count
+			}
+		}
+	}
+}
+
+// Iterates over the live records of a guild in id order starting after the
+// given id. Tags aren't fetched.
+func DatabaseRecordsAfter(guild string, after int64, limit int64) []*Record {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	const query = "select " + recordColumns +
+		"  from records where guild_id = ? and id > ? and deleted is null" +
+		"  order by id asc limit ?;"
+	rows, err := db.Query(query, guild, after, limit)
+	defer rows.Close()
+	check(err, query)
+
+	records := []*Record{}
+	for rows.Next() {
+		rec := &Record{}
+		check(rows.Scan(recordFields(rec)...), query)
+		records = append(records, rec)
+	}
+	return records
+}
+
 func DatabaseRecords(guild string, limit int64) []int64 {
 	lock.RLock()
 	defer lock.RUnlock()
 
 	Debug("records guild:%v limit:%v", guild, limit)
 
-	const query = "select id from records where guild_id = ? order by time desc limit ?;"
+	const query = "select id from records where guild_id = ? and deleted is null and hidden is null" +
+		"  order by time desc limit ?;"
 	rows, err := db.Query(query, guild, limit)
 	defer rows.Close()
 	check(err, query)
@@ -237,6 +820,7 @@ func DatabaseTag(guild, tag string) []int64 {
 
 	const query = "select record_id from tags, records" +
 		"  where tag = ? and tags.record_id = records.id and records.guild_id = ?" +
+		"  and records.deleted is null and records.hidden is null" +
 		"  order by records.time desc;"
 	rows, err := db.Query(query, tag, guild)
 	defer rows.Close()
@@ -258,6 +842,7 @@ func DatabaseTags(guild string) []string {
 
 	const query = "select distinct tag from tags, records" +
 		"  where tags.record_id = records.id and records.guild_id = ?" +
+		"  and records.deleted is null and records.hidden is null" +
 		"  order by tag asc;"
 	rows, err := db.Query(query, guild)
 	defer rows.Close()
@@ -273,47 +858,53 @@ func DatabaseTags(guild string) []string {
 	return tags
 }
 
-func DatabaseTagsSet(id int64, tags []string) {
+func DatabaseTagsSet(actor string, id int64, tags []string) {
 	lock.Lock()
 	defer lock.Unlock()
 
 	tx, err := db.Begin()
 	check(err, "begin")
 
-	for _, tag := range tags {
-		const query = "insert into tags(record_id, tag) values(?, ?);"
-		_, err := db.Exec(query, id, tag)
-		check(err, query)
-	}
+	txTagsSet(tx, actor, id, tags)
 
 	check(tx.Commit(), "commit")
 }
 
-func DatabaseTagsUnset(id int64, tags []string) {
+// Returns the id of the audit entry or 0 if no tags were added.
+func DatabaseTagsSetAuto(actor string, id int64, tags []string) int64 {
 	lock.Lock()
 	defer lock.Unlock()
 
 	tx, err := db.Begin()
 	check(err, "begin")
 
-	for _, tag := range tags {
-		const query = "delete from tags where record_id = ? and tag = ?;"
-		_, err := db.Exec(query, id, tag)
-		check(err, query)
-	}
+	entry := txTagsSetAuto(tx, actor, id, tags)
 
 	check(tx.Commit(), "commit")
+	return entry
 }
 
-func DatabaseStats() *Stats {
+func DatabaseTagsUnset(actor string, id int64, tags []string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	txTagsUnset(tx, actor, id, tags)
+
+	check(tx.Commit(), "commit")
+}
+
+func DatabaseStats(guild string) *Stats {
 	lock.RLock()
 	defer lock.RUnlock()
 
 	stats := &Stats{}
 
 	{
-		const query = "select count(id) from records;"
-		rows, err := db.Query(query)
+		const query = "select count(id) from records where guild_id = ?;"
+		rows, err := db.Query(query, guild)
 		defer rows.Close()
 		check(err, query)
 
@@ -322,8 +913,9 @@ func DatabaseStats() *Stats {
 	}
 
 	{
-		const query = "select count(*) from tags;"
-		rows, err := db.Query(query)
+		const query = "select count(*) from tags" +
+			"  join records on records.id = tags.record_id where guild_id = ?;"
+		rows, err := db.Query(query, guild)
 		defer rows.Close()
 		check(err, query)
 
@@ -332,8 +924,9 @@ func DatabaseStats() *Stats {
 	}
 
 	{
-		const query = "select count(distinct tag) from tags;"
-		rows, err := db.Query(query)
+		const query = "select count(distinct tag) from tags" +
+			"  join records on records.id = tags.record_id where guild_id = ?;"
+		rows, err := db.Query(query, guild)
 		defer rows.Close()
 		check(err, query)
 
@@ -342,8 +935,10 @@ func DatabaseStats() *Stats {
 	}
 
 	{
-		const query = "select tag, count(record_id) from tags group by tag;"
-		rows, err := db.Query(query)
+		const query = "select tag, count(record_id) from tags" +
+			"  join records on records.id = tags.record_id where guild_id = ?" +
+			"  group by tag;"
+		rows, err := db.Query(query, guild)
 		defer rows.Close()
 		check(err, query)
 
@@ -359,54 +954,188 @@ func DatabaseStats() *Stats {
 	return stats
 }
 
-func DatabaseQuery(params Query) []int64 {
+func DatabaseQuery(params Query) *QueryResult {
 	lock.Lock()
 	defer lock.Unlock()
 
-	query := "select id"
+	// Rows are scanned in the direction of the cursor and then flipped back in
+	// the display order of the sort.
+	dir := CursorNext
+	if params.HasCursor() {
+		dir = params.Cursor.Dir
+	}
+
+	key, cmp, order := "records.time", "<", "desc"
+	switch params.Sort {
+	case SortRank:
+		key, cmp, order = "records_fts.rank", ">", "asc"
+	case SortPopular:
+		key = "records.popularity"
+	}
+	if dir == CursorPrev {
+		if cmp == "<" {
+			cmp, order = ">", "asc"
+		} else {
+			cmp, order = "<", "desc"
+		}
+	}
+
+	query := "select records.id, " + key + " from records"
 	args := []interface{}{}
 
-	if params.HasTag() {
-		query += " from records, tags where records.id = tags.record_id"
-	} else {
-		query += " from records where true"
+	if params.HasSearch() {
+		query += ", records_fts"
 	}
 
-	query += " and records.guild_id = ?"
+	query += " where records.guild_id = ? and records.deleted is null and records.hidden is null"
 	args = append(args, params.GuildId)
 
-	if params.HasTag() {
-		query += " and tags.tag = ?"
-		args = append(args, params.Tag)
+	if params.HasTags() {
+		tagsQuery, tagsArgs := params.Tags.Sql()
+		query += " and " + tagsQuery
+		args = append(args, tagsArgs...)
 	}
 
-	if params.HasFrom() {
-		query += " and records." + params.From.Column + " < ?"
-		args = append(args, params.From.Id)
-	} else if params.HasSince() {
-		query += " and records." + params.Since.Column + " > ?"
-		args = append(args, params.Since.Id)
+	if params.HasSearch() {
+		query += " and records.id = records_fts.rowid and records_fts match ?"
+		args = append(args, params.Search)
 	}
 
-	if params.HasFrom() {
-		query += " order by records.time asc"
-	} else {
-		query += " order by records.time desc"
+	if params.HasCursor() {
+		query += " and (" + key + ", records.id) " + cmp + " (?, ?)"
+		switch params.Sort {
+		case SortRank:
+			args = append(args, params.Cursor.Rank, params.Cursor.Id)
+		case SortPopular:
+			args = append(args, params.Cursor.Popularity, params.Cursor.Id)
+		default:
+			args = append(args, params.Cursor.Time, params.Cursor.Id)
+		}
 	}
 
+	query += " order by " + key + " " + order + ", records.id " + order
+
+	// Fetch one extra row to know whether there's more to come.
 	query += " limit ?;"
-	args = append(args, params.Limit)
+	args = append(args, params.Limit+1)
 
 	rows, err := db.Query(query, args...)
 	defer rows.Close()
 	check(err, query)
 
-	ids := []int64{}
+	cursors := []Cursor{}
 	for rows.Next() {
-		var id int64
-		check(rows.Scan(&id), query)
-		ids = append(ids, id)
+		cursor := Cursor{Sort: params.Sort}
+		switch params.Sort {
+		case SortRank:
+			check(rows.Scan(&cursor.Id, &cursor.Rank), query)
+		case SortPopular:
+			check(rows.Scan(&cursor.Id, &cursor.Popularity), query)
+		default:
+			check(rows.Scan(&cursor.Id, &cursor.Time), query)
+		}
+		cursors = append(cursors, cursor)
 	}
 
-	return ids
+	more := int64(len(cursors)) > params.Limit
+	if more {
+		cursors = cursors[:params.Limit]
+	}
+
+	if dir == CursorPrev {
+		for i, j := 0, len(cursors)-1; i < j; i, j = i+1, j-1 {
+			cursors[i], cursors[j] = cursors[j], cursors[i]
+		}
+	}
+
+	result := &QueryResult{Ids: []int64{}}
+	for _, cursor := range cursors {
+		result.Ids = append(result.Ids, cursor.Id)
+	}
+
+	if len(cursors) == 0 {
+		return result
+	}
+
+	if (dir == CursorNext && more) || (dir == CursorPrev && params.HasCursor()) {
+		next := cursors[len(cursors)-1]
+		next.Dir = CursorNext
+		result.Next = next.String()
+	}
+
+	if (dir == CursorPrev && more) || (dir == CursorNext && params.HasCursor()) {
+		prev := cursors[0]
+		prev.Dir = CursorPrev
+		result.Prev = prev.String()
+	}
+
+	return result
+}
+
+func DatabaseKeyInsert(name, hash string, guilds []string, perms Perm) int64 {
+	lock.Lock()
+	defer lock.Unlock()
+
+	const query = "insert into keys(name, hash, guilds, perms, created) values(?, ?, ?, ?, ?);"
+	result, err := db.Exec(query, name, hash, strings.Join(guilds, ","), perms, time.Now())
+	check(err, query)
+
+	id, err := result.LastInsertId()
+	check(err, query)
+	return id
+}
+
+func databaseScanKey(rows *sql.Rows, query string) *Key {
+	key := &Key{}
+	var guilds string
+	check(rows.Scan(&key.Id, &key.Name, &guilds, &key.Perms, &key.Created, &key.Revoked), query)
+
+	key.Guilds = strings.Split(guilds, ",")
+	return key
+}
+
+// Returns nil if the hash doesn't match any key or if the key was revoked.
+func DatabaseKeyByHash(hash string) *Key {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	const query = "select id, name, guilds, perms, created, revoked is not null" +
+		"  from keys where hash = ? and revoked is null;"
+	rows, err := db.Query(query, hash)
+	defer rows.Close()
+	check(err, query)
+
+	if !rows.Next() {
+		return nil
+	}
+	return databaseScanKey(rows, query)
+}
+
+func DatabaseKeys() []*Key {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	const query = "select id, name, guilds, perms, created, revoked is not null from keys order by id asc;"
+	rows, err := db.Query(query)
+	defer rows.Close()
+	check(err, query)
+
+	keys := []*Key{}
+	for rows.Next() {
+		keys = append(keys, databaseScanKey(rows, query))
+	}
+	return keys
+}
+
+func DatabaseKeyRevoke(id int64) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	const query = "update keys set revoked = ? where id = ? and revoked is null;"
+	result, err := db.Exec(query, time.Now(), id)
+	check(err, query)
+
+	count, err := result.RowsAffected()
+	check(err, query)
+	return count > 0
 }
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Every mutation of a record or of its tags goes through one of the tx
+// functions below which record the state before and after the mutation in the
+// append-only audit table within the same transaction. The creation of
+// records by the scraper isn't audited as the record itself is the trace.
+//
+// Reverts are audited like any other mutation and point to the entry they
+// revert such that entries are never modified once written.
+
+const (
+	ActorSystem  = "system:"
+	ActorScraper = ActorSystem + "scraper"
+	ActorCdn     = ActorSystem + "cdn"
+	ActorRules   = ActorSystem + "rules"
+)
+
+const (
+	AuditTagsSet   = "tags.set"
+	AuditTagsUnset = "tags.unset"
+	AuditCaption   = "caption"
+	AuditHide      = "hide"
+	AuditDelete    = "delete"
+)
+
+var (
+	errAuditNotFound = errors.New("audit entry not found")
+	errAuditReverted = errors.New("audit entry already reverted")
+	errAuditConflict = errors.New("record was modified since the audit entry")
+)
+
+// Returns the id of the new entry or 0 if the mutation didn't change anything.
+// Reverts is the id of the entry reverted by the mutation, if any.
+func auditInsert(tx *sql.Tx, actor, action string, id int64, before, after interface{}, reverts int64) int64 {
+	beforeJson, err := json.Marshal(before)
+	check(err, "marshal")
+
+	afterJson, err := json.Marshal(after)
+	check(err, "marshal")
+
+	if string(beforeJson) == string(afterJson) {
+		return 0
+	}
+
+	var revertsValue interface{}
+	if reverts != 0 {
+		revertsValue = reverts
+	}
+
+	const query = "insert into audit(guild_id, actor, action, record_id, before, after, time, reverts)" +
+		"  select guild_id, ?, ?, id, ?, ?, ?, ? from records where id = ?;"
+	result, err := tx.Exec(query,
+		actor, action, string(beforeJson), string(afterJson), time.Now(), revertsValue, id)
+	check(err, query)
+
+	entry, err := result.LastInsertId()
+	check(err, query)
+	return entry
+}
+
+func txTags(tx *sql.Tx, id int64) []string {
+	const query = "select tag from tags where record_id = ? order by tag asc;"
+	rows, err := tx.Query(query, id)
+	defer rows.Close()
+	check(err, query)
+
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		check(rows.Scan(&tag), query)
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// The mutations are split from their auditing such that reverts can be audited
+// along with the entry they revert. Each returns the state before and after the
+// mutation.
+
+func txTagsAdd(tx *sql.Tx, id int64, tags []string) ([]string, []string) {
+	before := txTags(tx, id)
+
+	for _, tag := range tags {
+		const query = "insert into tags(record_id, tag) values(?, ?) on conflict do nothing;"
+		_, err := tx.Exec(query, id, tag)
+		check(err, query)
+	}
+
+	ftsSync(tx, "id", id)
+	return before, txTags(tx, id)
+}
+
+func txTagsRemove(tx *sql.Tx, id int64, tags []string) ([]string, []string) {
+	before := txTags(tx, id)
+
+	for _, tag := range tags {
+		const query = "delete from tags where record_id = ? and tag = ?;"
+		_, err := tx.Exec(query, id, tag)
+		check(err, query)
+	}
+
+	ftsSync(tx, "id", id)
+	return before, txTags(tx, id)
+}
+
+func txCaptionUpdate(tx *sql.Tx, id int64, caption string) (string, string) {
+	before, _, _ := txRecordState(tx, id)
+
+	const query = "update records set caption = ? where id = ?;"
+	_, err := tx.Exec(query, caption, id)
+	check(err, query)
+
+	ftsSync(tx, "id", id)
+	return before, caption
+}
+
+func txHiddenUpdate(tx *sql.Tx, id int64, hidden bool) (bool, bool) {
+	_, before, _ := txRecordState(tx, id)
+	if before == hidden {
+		return before, hidden
+	}
+
+	var value interface{}
+	if hidden {
+		value = time.Now()
+	}
+
+	const query = "update records set hidden = ? where id = ?;"
+	_, err := tx.Exec(query, value, id)
+	check(err, query)
+
+	return before, hidden
+}
+
+func txDeletedUpdate(tx *sql.Tx, id int64, deleted bool) (bool, bool) {
+	_, _, before := txRecordState(tx, id)
+	if before == deleted {
+		return before, deleted
+	}
+
+	var value interface{}
+	if deleted {
+		value = time.Now()
+	}
+
+	const query = "update records set deleted = ? where id = ?;"
+	_, err := tx.Exec(query, value, id)
+	check(err, query)
+
+	return before, deleted
+}
+
+func txTagsSet(tx *sql.Tx, actor string, id int64, tags []string) int64 {
+	before, after := txTagsAdd(tx, id, tags)
+	return auditInsert(tx, actor, AuditTagsSet, id, before, after, 0)
+}
+
+func txTagsUnset(tx *sql.Tx, actor string, id int64, tags []string) int64 {
+	before, after := txTagsRemove(tx, id, tags)
+	return auditInsert(tx, actor, AuditTagsUnset, id, before, after, 0)
+}
+
+// Returns the tags of a record whose last change was a removal by someone other
+// than the system, which automated tagging must not bring back.
+func txTagsRemoved(tx *sql.Tx, id int64) map[string]bool {
+	const query = "select actor, action, before, after from audit" +
+		"  where record_id = ? and action in (?, ?) order by id asc;"
+	rows, err := tx.Query(query, id, AuditTagsSet, AuditTagsUnset)
+	defer rows.Close()
+	check(err, query)
+
+	removed := make(map[string]bool)
+	for rows.Next() {
+		var actor, action, beforeJson, afterJson string
+		check(rows.Scan(&actor, &action, &beforeJson, &afterJson), query)
+
+		var before, after []string
+		check(json.Unmarshal([]byte(beforeJson), &before), "unmarshal")
+		check(json.Unmarshal([]byte(afterJson), &after), "unmarshal")
+
+		if action == AuditTagsSet {
+			for _, tag := range tagsDiff(after, before) {
+				delete(removed, tag)
+			}
+		} else if !strings.HasPrefix(actor, ActorSystem) {
+			for _, tag := range tagsDiff(before, after) {
+				removed[tag] = true
+			}
+		}
+	}
+	return removed
+}
+
+// Sets the tags that weren't removed by hand from the record. Used by the
+// automated tagging when applied to existing records.
+func txTagsSetAuto(tx *sql.Tx, actor string, id int64, tags []string) int64 {
+	removed := txTagsRemoved(tx, id)
+
+	filtered := []string{}
+	for _, tag := range tags {
+		if !removed[tag] {
+			filtered = append(filtered, tag)
+		}
+	}
+
+	if len(filtered) == 0 {
+		return 0
+	}
+	return txTagsSet(tx, actor, id, filtered)
+}
+
+// Rewrites a materialized tag of the live records matching the filter, a
+// condition on the records table, from one value to the other. Records where
+// the tag was removed by hand are left alone.
+func txTagRename(tx *sql.Tx, actor, filter string, args []interface{}, from, to string) {
+	ids := []int64{}
+	{
+		query := "select records.id from records, tags" +
+			"  where " + filter + " and records.deleted is null" +
+			"    and tags.record_id = records.id and tags.tag = ?;"
+		rows, err := tx.Query(query, append(args, from)...)
+		defer rows.Close()
+		check(err, query)
+
+		for rows.Next() {
+			var id int64
+			check(rows.Scan(&id), query)
+			ids = append(ids, id)
+		}
+	}
+
+	for _, id := range ids {
+		txTagsUnset(tx, actor, id, []string{from})
+		txTagsSet(tx, actor, id, []string{to})
+	}
+}
+
+func txRecordState(tx *sql.Tx, id int64) (string, bool, bool) {
+	const query = "select coalesce(caption, ''), hidden is not null, deleted is not null" +
+		"  from records where id = ?;"
+	rows, err := tx.Query(query, id)
+	defer rows.Close()
+	check(err, query)
+
+	var caption string
+	var hidden, deleted bool
+	if rows.Next() {
+		check(rows.Scan(&caption, &hidden, &deleted), query)
+	}
+	return caption, hidden, deleted
+}
+
+func txRecordCaption(tx *sql.Tx, actor string, id int64, caption string) int64 {
+	before, after := txCaptionUpdate(tx, id, caption)
+	return auditInsert(tx, actor, AuditCaption, id, before, after, 0)
+}
+
+func txRecordHide(tx *sql.Tx, actor string, id int64, hidden bool) int64 {
+	before, after := txHiddenUpdate(tx, id, hidden)
+	return auditInsert(tx, actor, AuditHide, id, before, after, 0)
+}
+
+func txRecordDelete(tx *sql.Tx, actor string, id int64, deleted bool) int64 {
+	before, after := txDeletedUpdate(tx, id, deleted)
+	return auditInsert(tx, actor, AuditDelete, id, before, after, 0)
+}
+
+// Entries are never updated so the entry that reverted an entry is looked up
+// through its reverts column.
+const auditRevertedBy = "coalesce((select reverted.id from audit as reverted" +
+	"  where reverted.reverts = audit.id order by reverted.id asc limit 1), 0)"
+
+func DatabaseAudit(params AuditQuery) []*AuditEntry {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	query := "select id, guild_id, actor, action, record_id, before, after, time," +
+		"    coalesce(reverts, 0), " + auditRevertedBy +
+		"  from audit where guild_id = ?"
+	args := []interface{}{params.GuildId}
+
+	if params.RecordId > 0 {
+		query += " and record_id = ?"
+		args = append(args, params.RecordId)
+	}
+	if params.Actor != "" {
+		query += " and actor = ?"
+		args = append(args, params.Actor)
+	}
+	if params.Action != "" {
+		query += " and action = ?"
+		args = append(args, params.Action)
+	}
+	if params.Before > 0 {
+		query += " and id < ?"
+		args = append(args, params.Before)
+	}
+
+	query += " order by id desc limit ?;"
+	args = append(args, params.Limit)
+
+	rows, err := db.Query(query, args...)
+	defer rows.Close()
+	check(err, query)
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		entry := &AuditEntry{}
+		var before, after string
+		check(rows.Scan(
+			&entry.Id,
+			&entry.GuildId,
+			&entry.Actor,
+			&entry.Action,
+			&entry.RecordId,
+			&before,
+			&after,
+			&entry.Time,
+			&entry.Reverts,
+			&entry.RevertedBy), query)
+
+		entry.Before = json.RawMessage(before)
+		entry.After = json.RawMessage(after)
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func txAuditEntry(tx *sql.Tx, guild string, id int64) *AuditEntry {
+	const query = "select id, record_id, action, before, after, " + auditRevertedBy +
+		"  from audit where guild_id = ? and id = ?;"
+	rows, err := tx.Query(query, guild, id)
+	defer rows.Close()
+	check(err, query)
+
+	if !rows.Next() {
+		return nil
+	}
+
+	entry := &AuditEntry{GuildId: guild}
+	var before, after string
+	check(rows.Scan(&entry.Id, &entry.RecordId, &entry.Action, &before, &after, &entry.RevertedBy), query)
+
+	entry.Before = json.RawMessage(before)
+	entry.After = json.RawMessage(after)
+	return entry
+}
+
+func tagsDiff(lhs, rhs []string) []string {
+	set := make(map[string]bool)
+	for _, tag := range rhs {
+		set[tag] = true
+	}
+
+	diff := []string{}
+	for _, tag := range lhs {
+		if !set[tag] {
+			diff = append(diff, tag)
+		}
+	}
+	return diff
+}
+
+func txAuditRevert(tx *sql.Tx, actor string, entry *AuditEntry) (int64, error) {
+	id := entry.RecordId
+
+	switch entry.Action {
+
+	case AuditTagsSet, AuditTagsUnset:
+		var before, after []string
+		check(json.Unmarshal(entry.Before, &before), "unmarshal")
+		check(json.Unmarshal(entry.After, &after), "unmarshal")
+
+		if entry.Action == AuditTagsSet {
+			current, reverted := txTagsRemove(tx, id, tagsDiff(after, before))
+			return auditInsert(tx, actor, AuditTagsUnset, id, current, reverted, entry.Id), nil
+		}
+		current, reverted := txTagsAdd(tx, id, tagsDiff(before, after))
+		return auditInsert(tx, actor, AuditTagsSet, id, current, reverted, entry.Id), nil
+
+	case AuditCaption:
+		var before, after string
+		check(json.Unmarshal(entry.Before, &before), "unmarshal")
+		check(json.Unmarshal(entry.After, &after), "unmarshal")
+
+		if current, _, _ := txRecordState(tx, id); current != after {
+			return 0, errAuditConflict
+		}
+		current, reverted := txCaptionUpdate(tx, id, before)
+		return auditInsert(tx, actor, AuditCaption, id, current, reverted, entry.Id), nil
+
+	case AuditHide:
+		var before bool
+		check(json.Unmarshal(entry.Before, &before), "unmarshal")
+		current, reverted := txHiddenUpdate(tx, id, before)
+		return auditInsert(tx, actor, AuditHide, id, current, reverted, entry.Id), nil
+
+	case AuditDelete:
+		var before bool
+		check(json.Unmarshal(entry.Before, &before), "unmarshal")
+		current, reverted := txDeletedUpdate(tx, id, before)
+		return auditInsert(tx, actor, AuditDelete, id, current, reverted, entry.Id), nil
+
+	default:
+		return 0, errors.New("unknown audit action '" + entry.Action + "'")
+	}
+}
+
+// Applies the inverse of an audit entry which is itself audited and points back
+// to the reverted entry. Entries that no longer match the state of the record
+// can't be reverted.
+func DatabaseAuditRevert(actor, guild string, id int64) (int64, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	entry := txAuditEntry(tx, guild, id)
+	if entry == nil {
+		check(tx.Rollback(), "rollback")
+		return 0, errAuditNotFound
+	} else if entry.RevertedBy != 0 {
+		check(tx.Rollback(), "rollback")
+		return 0, errAuditReverted
+	}
+
+	revert, err := txAuditRevert(tx, actor, entry)
+	if err == nil && revert == 0 {
+		err = errAuditConflict
+	}
+	if err != nil {
+		check(tx.Rollback(), "rollback")
+		return 0, err
+	}
+
+	check(tx.Commit(), "commit")
+	return revert, nil
+}
@@ -0,0 +1,107 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuditRevert(t *testing.T) {
+	testDatabase(t)
+
+	id := DatabaseRecordInsert(&Record{
+		GuildId:   "1",
+		ChannelId: "2",
+		MessageId: "3",
+		ImageId:   "4",
+		Time:      time.Now(),
+		Path:      "https://i.imgur.com/a.png",
+		Tags:      []string{"cat"},
+	})
+	DatabaseTagsSet("user:7", id, []string{"dog"})
+
+	entries := DatabaseAudit(AuditQuery{GuildId: "1", Limit: 10})
+	if len(entries) != 1 {
+		t.Fatalf("expected a single entry, got %v", len(entries))
+	}
+	set := entries[0]
+
+	revert, err := DatabaseAuditRevert("user:8", "1", set.Id)
+	if err != nil {
+		t.Fatalf("revert: unexpected error: %v", err)
+	}
+
+	if tags := DatabaseRecord("1", id).Tags; !reflect.DeepEqual(tags, []string{"cat"}) {
+		t.Errorf("revert: got tags %q", tags)
+	}
+
+	entries = DatabaseAudit(AuditQuery{GuildId: "1", Limit: 10})
+	if len(entries) != 2 || entries[0].Id != revert {
+		t.Fatalf("revert: unexpected entries %+v", entries)
+	}
+	if entry := entries[0]; entry.Reverts != set.Id || entry.Action != AuditTagsUnset || entry.Actor != "user:8" {
+		t.Errorf("revert: unexpected entry %+v", *entry)
+	}
+	if entry := entries[1]; entry.RevertedBy != revert || string(entry.After) != string(set.After) {
+		t.Errorf("reverted: unexpected entry %+v", *entry)
+	}
+
+	if _, err := DatabaseAuditRevert("user:8", "1", set.Id); err != errAuditReverted {
+		t.Errorf("second revert: got %v, expected %v", err, errAuditReverted)
+	}
+	if _, err := DatabaseAuditRevert("user:8", "2", revert); err != errAuditNotFound {
+		t.Errorf("other guild: got %v, expected %v", err, errAuditNotFound)
+	}
+
+	// Reverting the revert brings the tag back.
+	if _, err := DatabaseAuditRevert("user:7", "1", revert); err != nil {
+		t.Errorf("revert of revert: unexpected error: %v", err)
+	}
+	if tags := DatabaseRecord("1", id).Tags; !reflect.DeepEqual(tags, []string{"cat", "dog"}) {
+		t.Errorf("revert of revert: got tags %q", tags)
+	}
+}
+
+func TestTagsSetAuto(t *testing.T) {
+	testDatabase(t)
+
+	id := DatabaseRecordInsert(&Record{
+		GuildId:   "1",
+		ChannelId: "2",
+		MessageId: "3",
+		ImageId:   "4",
+		Time:      time.Now(),
+		Path:      "https://i.imgur.com/a.png",
+	})
+
+	if entry := DatabaseTagsSetAuto(ActorRules, id, []string{"cat"}); entry == 0 {
+		t.Errorf("new tag: expected an audit entry")
+	}
+	if entry := DatabaseTagsSetAuto(ActorRules, id, []string{"cat"}); entry != 0 {
+		t.Errorf("existing tag: got entry %v, expected none", entry)
+	}
+
+	// Removed by the system, the tag can come back.
+	DatabaseTagsUnset(ActorScraper, id, []string{"cat"})
+	if entry := DatabaseTagsSetAuto(ActorRules, id, []string{"cat"}); entry == 0 {
+		t.Errorf("removed by system: expected an audit entry")
+	}
+
+	// Removed by hand, the tag stays removed until someone sets it again.
+	DatabaseTagsUnset("user:7", id, []string{"cat"})
+	if entry := DatabaseTagsSetAuto(ActorRules, id, []string{"cat", "dog"}); entry == 0 {
+		t.Errorf("removed by hand: expected an audit entry for the other tag")
+	}
+	if tags := DatabaseRecord("1", id).Tags; !reflect.DeepEqual(tags, []string{"dog"}) {
+		t.Errorf("removed by hand: got tags %q", tags)
+	}
+
+	DatabaseTagsSet("user:8", id, []string{"cat"})
+	DatabaseTagsUnset(ActorScraper, id, []string{"cat"})
+	if entry := DatabaseTagsSetAuto(ActorRules, id, []string{"cat"}); entry == 0 {
+		t.Errorf("set again by hand: expected an audit entry")
+	}
+}
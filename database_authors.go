@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Authors are tracked per guild by their Discord user id as their nickname is
+// guild specific. The @ tags of their records are materialized from their
+// display name and are rewritten whenever the author is renamed. Authors whose
+// display name is already taken by another author of the guild are told apart
+// by the end of their id. Mentions of an author in captions aren't linked to
+// the author and keep the name they were tagged with.
+
+func txAuthor(tx *sql.Tx, guild, id string) *Author {
+	const query = "select id, username, coalesce(nickname, ''), coalesce(avatar, ''), tag" +
+		"  from authors where guild_id = ? and id = ?;"
+	rows, err := tx.Query(query, guild, id)
+	defer rows.Close()
+	check(err, query)
+
+	if !rows.Next() {
+		return nil
+	}
+
+	author := &Author{}
+	check(rows.Scan(&author.Id, &author.Username, &author.Nickname, &author.Avatar, &author.Tag), query)
+	return author
+}
+
+func authorTag(author *Author, taken bool) string {
+	if !taken {
+		return author.Name()
+	}
+
+	suffix := author.Id
+	if len(suffix) > 4 {
+		suffix = suffix[len(suffix)-4:]
+	}
+	return author.Name() + "~" + suffix
+}
+
+// Returns the tag of the author given the other authors of the guild.
+func txAuthorTag(tx *sql.Tx, guild string, author *Author) string {
+	const query = "select count(*) from authors where guild_id = ? and id != ? and tag = ?;"
+	rows, err := tx.Query(query, guild, author.Id, author.Name())
+	defer rows.Close()
+	check(err, query)
+
+	var count int
+	rows.Next()
+	check(rows.Scan(&count), query)
+
+	return authorTag(author, count > 0)
+}
+
+func DatabaseAuthorTag(guild string, author *Author) string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	tag := txAuthorTag(tx, guild, author)
+
+	check(tx.Commit(), "commit")
+	return tag
+}
+
+func txAuthorHistory(tx *sql.Tx, guild string, author *Author) {
+	const query = "insert into author_history(guild_id, author_id, username, nickname, time)" +
+		"  values(?, ?, ?, nullif(?, ''), ?);"
+	_, err := tx.Exec(query, guild, author.Id, author.Username, author.Nickname, time.Now())
+	check(err, query)
+}
+
+func txAuthorRename(tx *sql.Tx, actor, guild, id, from, to string) {
+	txTagRename(tx, actor, "records.guild_id = ? and records.author_id = ?",
+		[]interface{}{guild, id}, "@"+from, "@"+to)
+}
+
+// Records the author if it isn't already known and returns the current tag of
+// the author. Used for historical messages which must not override the more
+// recent names that may already be known. New authors keep the tag they were
+// given, if any, as their records may already carry it.
+func txAuthorSeen(tx *sql.Tx, guild string, author *Author) string {
+	current := txAuthor(tx, guild, author.Id)
+	if current == nil {
+		tag := author.Tag
+		if tag == "" {
+			tag = txAuthorTag(tx, guild, author)
+		}
+
+		const query = "insert into authors(guild_id, id, username, nickname, avatar, tag, updated)" +
+			"  values(?, ?, ?, nullif(?, ''), nullif(?, ''), ?, ?);"
+		_, err := tx.Exec(query,
+			guild, author.Id, author.Username, author.Nickname, author.Avatar, tag, time.Now())
+		check(err, query)
+
+		txAuthorHistory(tx, guild, author)
+		return tag
+	}
+	return current.Tag
+}
+
+func DatabaseAuthorSeen(guild string, author *Author) string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	name := txAuthorSeen(tx, guild, author)
+
+	check(tx.Commit(), "commit")
+	return name
+}
+
+// Returns the tags of the known authors among the given ids.
+func DatabaseAuthorNames(guild string, ids []string) map[string]string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	names := make(map[string]string)
+	for _, id := range ids {
+		if author := txAuthor(tx, guild, id); author != nil {
+			names[id] = author.Tag
+		}
+	}
+
+	check(tx.Commit(), "commit")
+	return names
+}
+
+// Updates the author with its latest known names and avatar and propagates a
+// change of display name to the author's records. Returns the author's tag.
+func DatabaseAuthorUpdate(actor, guild string, author *Author) string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	current := txAuthor(tx, guild, author.Id)
+
+	tag := ""
+	if current != nil && current.Name() == author.Name() {
+		tag = current.Tag
+	} else {
+		tag = txAuthorTag(tx, guild, author)
+	}
+
+	{
+		const query = "insert into authors(guild_id, id, username, nickname, avatar, tag, updated)" +
+			"  values(?, ?, ?, nullif(?, ''), nullif(?, ''), ?, ?)" +
+			"  on conflict(guild_id, id) do update set" +
+			"    username = excluded.username, nickname = excluded.nickname," +
+			"    avatar = excluded.avatar, tag = excluded.tag, updated = excluded.updated;"
+		_, err := tx.Exec(query,
+			guild, author.Id, author.Username, author.Nickname, author.Avatar, tag, time.Now())
+		check(err, query)
+	}
+
+	if current == nil || current.Username != author.Username || current.Nickname != author.Nickname {
+		txAuthorHistory(tx, guild, author)
+	}
+
+	if current != nil && current.Tag != tag {
+		txAuthorRename(tx, actor, guild, author.Id, current.Tag, tag)
+		Info("rename guild:%v author:%v %v -> %v", guild, author.Id, current.Tag, tag)
+	}
+
+	check(tx.Commit(), "commit")
+	return tag
+}
+
+// Links a record to its author and replaces the @ tag it was ingested with by
+// the author's tag. Records may also carry the @ tags of the users mentioned in
+// their caption so the ingested tag is the one matching one of the names the
+// author is known by. The author's tag is only added if none match.
+func DatabaseRecordAuthorSet(actor, guild string, id int64, author *Author) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	tag := "@" + txAuthorSeen(tx, guild, author)
+
+	{
+		const query = "update records set author_id = ? where id = ?;"
+		_, err := tx.Exec(query, author.Id, id)
+		check(err, query)
+	}
+
+	if old := txRecordAuthorTag(tx, guild, id, author); old == "" {
+		txTagsSet(tx, actor, id, []string{tag})
+	} else if old != tag {
+		txTagsUnset(tx, actor, id, []string{old})
+		txTagsSet(tx, actor, id, []string{tag})
+	}
+
+	check(tx.Commit(), "commit")
+}
+
+// Returns the @ tag of the record matching any of the names of the author.
+func txRecordAuthorTag(tx *sql.Tx, guild string, id int64, author *Author) string {
+	names := map[string]bool{
+		"@" + author.Username: true,
+		"@" + author.Name():   true,
+	}
+
+	{
+		const query = "select username, coalesce(nickname, '') from author_history" +
+			"  where guild_id = ? and author_id = ?;"
+		rows, err := tx.Query(query, guild, author.Id)
+		defer rows.Close()
+		check(err, query)
+
+		for rows.Next() {
+			var username, nickname string
+			check(rows.Scan(&username, &nickname), query)
+			names["@"+username] = true
+			if nickname != "" {
+				names["@"+nickname] = true
+			}
+		}
+	}
+
+	for _, tag := range txTags(tx, id) {
+		if names[tag] {
+			return tag
+		}
+	}
+	return ""
+}
+
+// Iterates over the live records of a guild that aren't linked to an author.
+func DatabaseRecordsUnattributed(guild string, after int64, limit int64) []*Record {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	const query = "select " + recordColumns +
+		"  from records where guild_id = ? and id > ? and deleted is null" +
+		"    and coalesce(author_id, '') = ''" +
+		"  order by id asc limit ?;"
+	rows, err := db.Query(query, guild, after, limit)
+	defer rows.Close()
+	check(err, query)
+
+	records := []*Record{}
+	for rows.Next() {
+		rec := &Record{}
+		check(rows.Scan(recordFields(rec)...), query)
+		records = append(records, rec)
+	}
+	return records
+}
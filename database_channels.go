@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Guild and channel metadata is refreshed from Discord. The # tags of records
+// are materialized from the name of their channel and are rewritten whenever
+// the channel is renamed.
+
+func txChannelName(tx *sql.Tx, id string) (string, bool) {
+	const query = "select name from channels where id = ?;"
+	rows, err := tx.Query(query, id)
+	defer rows.Close()
+	check(err, query)
+
+	if !rows.Next() {
+		return "", false
+	}
+
+	var name string
+	check(rows.Scan(&name), query)
+	return name, true
+}
+
+func txChannelRename(tx *sql.Tx, actor, id, from, to string) {
+	txTagRename(tx, actor, "records.chan_id = ?", []interface{}{id}, "#"+from, "#"+to)
+}
+
+func DatabaseGuildUpdate(guild *Guild) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	const query = "insert into guilds(id, name, icon, updated) values(?, ?, nullif(?, ''), ?)" +
+		"  on conflict(id) do update set" +
+		"    name = excluded.name, icon = excluded.icon, updated = excluded.updated;"
+	_, err := db.Exec(query, guild.Id, guild.Name, guild.Icon, time.Now())
+	check(err, query)
+}
+
+// Updates the channel with its latest metadata and propagates a rename to the
+// channel's records.
+func DatabaseChannelUpdate(actor string, channel *Channel) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	old, ok := txChannelName(tx, channel.Id)
+
+	{
+		const query = "insert into channels(id, guild_id, name, topic, nsfw, position, parent_id, updated)" +
+			"  values(?, ?, ?, nullif(?, ''), ?, ?, nullif(?, ''), ?)" +
+			"  on conflict(id) do update set" +
+			"    guild_id = excluded.guild_id, name = excluded.name, topic = excluded.topic," +
+			"    nsfw = excluded.nsfw, position = excluded.position," +
+			"    parent_id = excluded.parent_id, updated = excluded.updated;"
+		_, err := tx.Exec(query,
+			channel.Id,
+			channel.GuildId,
+			channel.Name,
+			channel.Topic,
+			channel.Nsfw,
+			channel.Position,
+			channel.ParentId,
+			time.Now())
+		check(err, query)
+	}
+
+	if ok && old != channel.Name {
+		txChannelRename(tx, actor, channel.Id, old, channel.Name)
+		Info("rename chan:%v %v -> %v", channel.Id, old, channel.Name)
+	}
+
+	check(tx.Commit(), "commit")
+}
+
+func DatabaseChannelName(id string) string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	name, _ := txChannelName(tx, id)
+
+	check(tx.Commit(), "commit")
+	return name
+}
@@ -0,0 +1,142 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordReactions(t *testing.T) {
+	testDatabase(t)
+
+	insert := func(msg string, reactions map[string]int) int64 {
+		return DatabaseRecordInsert(&Record{
+			GuildId:   "1",
+			ChannelId: "2",
+			MessageId: msg,
+			ImageId:   "url:a",
+			Source:    SourceLink,
+			Time:      time.Now(),
+			Path:      "https://i.imgur.com/a.png",
+			Reactions: reactions,
+		})
+	}
+
+	tests := []struct {
+		name      string
+		msg       string
+		reactions map[string]int
+		expected  map[string]int
+	}{
+		{"insert", "3", map[string]int{"a": 2, "b": 1}, map[string]int{"a": 2, "b": 1}},
+		{"rescrape", "3", map[string]int{"a": 3}, map[string]int{"a": 3}},
+		{"unknown", "3", nil, map[string]int{"a": 3}},
+		{"other message", "4", map[string]int{"c": 1}, map[string]int{"a": 3}},
+		{"all removed", "3", map[string]int{}, nil},
+	}
+
+	for _, test := range tests {
+		id := insert(test.msg, test.reactions)
+		if reactions := DatabaseRecord("1", id).Reactions; !reflect.DeepEqual(reactions, test.expected) {
+			t.Errorf("%v: got %v, expected %v", test.name, reactions, test.expected)
+		}
+	}
+}
+
+func TestReactionTags(t *testing.T) {
+	testDatabase(t)
+
+	id := DatabaseRecordInsert(&Record{
+		GuildId:   "1",
+		ChannelId: "2",
+		MessageId: "3",
+		ImageId:   "4",
+		Time:      time.Now(),
+		Path:      "https://i.imgur.com/a.png",
+	})
+
+	DatabaseReactionAdd(ActorScraper, "3", "meme", 1, "meme")
+	if tags := DatabaseRecord("1", id).Tags; !reflect.DeepEqual(tags, []string{"meme"}) {
+		t.Errorf("mapped: got tags %q", tags)
+	}
+
+	DatabaseTagsUnset("user:7", id, []string{"meme"})
+	DatabaseReactionAdd(ActorScraper, "3", "meme", 1, "meme")
+	if tags := DatabaseRecord("1", id).Tags; len(tags) != 0 {
+		t.Errorf("removed by hand: got tags %q", tags)
+	}
+	if reactions := DatabaseRecord("1", id).Reactions; reactions["meme"] != 2 {
+		t.Errorf("removed by hand: got reactions %v", reactions)
+	}
+}
+
+func testPage(msg string) []*Record {
+	return []*Record{{
+		GuildId:   "1",
+		ChannelId: "2",
+		MessageId: msg,
+		ImageId:   "img-" + msg,
+		Time:      time.Now(),
+		Path:      "https://i.imgur.com/" + msg + ".png",
+	}}
+}
+
+// A failed insert kills the process so the page is written by a child process
+// which must die without moving the checkpoint.
+func TestRecordsInsertPageCrash(t *testing.T) {
+	if file := os.Getenv("ARCHIVIST_TEST_CRASH"); file != "" {
+		DatabaseOpen(file, false)
+		authors := []*Author{{Id: "7", Username: "bob"}}
+		recs := append(testPage("20"), testPage("boom")...)
+		DatabaseRecordsInsertPage("1", authors, recs, "2", SubLatest, "boom")
+		return
+	}
+
+	file := testDatabase(t)
+	DatabaseSubSeed("1", "2")
+	DatabaseRecordsInsertPage("1", nil, testPage("10"), "2", SubLatest, "10")
+
+	const query = "create trigger boom before insert on records when new.msg_id = 'boom'" +
+		"  begin select raise(abort, 'boom'); end;"
+	if _, err := db.Exec(query); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRecordsInsertPageCrash$")
+	cmd.Env = append(os.Environ(), "ARCHIVIST_TEST_CRASH="+file)
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "boom") {
+		t.Fatalf("expected the insert to fail, got %v: %s", err, out)
+	}
+
+	latest := func() string {
+		for _, entry := range DatabaseSubs() {
+			if entry.Channel == "2" {
+				return entry.Latest
+			}
+		}
+		return ""
+	}
+
+	if pos := latest(); pos != "10" {
+		t.Errorf("checkpoint: got %q, expected %q", pos, "10")
+	}
+	if recs := DatabaseRecordsAfter("1", 0, 10); len(recs) != 1 || recs[0].MessageId != "10" {
+		t.Errorf("records: expected only the first page, got %v", len(recs))
+	}
+	if names := DatabaseAuthorNames("1", []string{"7"}); len(names) != 0 {
+		t.Errorf("authors: expected none, got %v", names)
+	}
+
+	// Without the failure, the same page moves the checkpoint.
+	DatabaseRecordsInsertPage("1", nil, testPage("20"), "2", SubLatest, "20")
+	if pos := latest(); pos != "20" {
+		t.Errorf("retried checkpoint: got %q, expected %q", pos, "20")
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
@@ -11,12 +16,23 @@ var discord *discordgo.Session
 
 type Message discordgo.Message
 type Attachment discordgo.MessageAttachment
+type Emoji discordgo.Emoji
 
 func DiscordConnect() {
 	var err error
 	if discord, err = discordgo.New("Bot " + Config.Discord.Token); err != nil {
 		Fatal("unable to connect to discord: %v", err)
 	}
+
+	// Events are dispatched in order so that the subscription checkpoints only
+	// ever move forward.
+	discord.SyncEvents = true
+}
+
+func DiscordOpen() {
+	if err := discord.Open(); err != nil {
+		Fatal("unable to open discord gateway: %v", err)
+	}
 }
 
 func DiscordClose() {
@@ -30,6 +46,8 @@ const (
 	backwards = iota
 )
 
+const DiscordPageSize = 100
+
 type MessageSorter struct {
 	msgs      []*discordgo.Message
 	direction int
@@ -41,9 +59,9 @@ func (sorter MessageSorter) Len() int {
 
 func (sorter MessageSorter) Less(lhs, rhs int) bool {
 	if sorter.direction == forward {
-		return sorter.msgs[lhs].ID < sorter.msgs[rhs].ID
+		return DiscordIdLess(sorter.msgs[lhs].ID, sorter.msgs[rhs].ID)
 	} else {
-		return sorter.msgs[rhs].ID < sorter.msgs[lhs].ID
+		return DiscordIdLess(sorter.msgs[rhs].ID, sorter.msgs[lhs].ID)
 	}
 }
 
@@ -53,63 +71,400 @@ func (sorter MessageSorter) Swap(lhs, rhs int) {
 	sorter.msgs[rhs] = tmp
 }
 
-type MessageIt struct {
-	Channel string
-	Pos     string
+// Pages of messages are sorted in the direction of the scrape.
+func discordMessagePage(channel, before, after string, direction int) ([]*Message, error) {
+	page, err := discord.ChannelMessages(channel, DiscordPageSize, before, after, "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(MessageSorter{page, direction})
 
-	pending   []*discordgo.Message
-	index     int
-	direction int
+	msgs := []*Message{}
+	for _, msg := range page {
+		msgs = append(msgs, (*Message)(msg))
+	}
+	return msgs, nil
 }
 
-func (it *MessageIt) DiscordItNext() (*Message, error) {
-	if it.index == len(it.pending) {
-		var err error
+// Messages posted after the given message, oldest first. The latest messages of
+// the channel are returned if no message is given.
+func DiscordMessagesAfter(channel, after string) ([]*Message, error) {
+	return discordMessagePage(channel, "", after, forward)
+}
 
-		before := ""
-		if it.direction == backwards {
-			before = it.Pos
-		}
+// Messages posted before the given message, newest first. The latest messages
+// of the channel are returned if no message is given.
+func DiscordMessagesBefore(channel, before string) ([]*Message, error) {
+	return discordMessagePage(channel, before, "", backwards)
+}
 
-		after := ""
-		if it.direction == forward {
-			after = it.Pos
-		}
+// How long until the rate limit bucket of the channel's messages allows another
+// request.
+func DiscordRateWait(channel string) time.Duration {
+	limiter := discord.Ratelimiter
+	bucket := limiter.GetBucket(discordgo.EndpointChannelMessages(channel))
 
-		if it.pending, err = discord.ChannelMessages(it.Channel, 100, before, after, ""); err != nil {
-			return nil, err
-		}
-		it.index = 0
-		sort.Sort(MessageSorter{it.pending, it.direction})
+	bucket.Lock()
+	defer bucket.Unlock()
+	return limiter.GetWaitTime(bucket, 1)
+}
+
+func DiscordMessage(channel, id string) (*Message, error) {
+	msg, err := discord.ChannelMessage(channel, id)
+	return (*Message)(msg), err
+}
+
+func discordAuthor(user *discordgo.User, nick string) *Author {
+	return &Author{
+		Id:       user.ID,
+		Username: user.Username,
+		Nickname: nick,
+		Avatar:   user.Avatar,
 	}
+}
 
-	if len(it.pending) == 0 {
-		return nil, nil
+// The nickname of the author is only known for messages received through the
+// gateway which carry the author's guild member.
+func DiscordMessageAuthor(msg *Message) *Author {
+	nick := ""
+	if msg.Member != nil {
+		nick = msg.Member.Nick
 	}
+	return discordAuthor(msg.Author, nick)
+}
 
-	msg := it.pending[it.index]
-	it.index++
+func DiscordMentionAuthors(msg *Message) []*Author {
+	authors := []*Author{}
+	for _, user := range msg.Mentions {
+		authors = append(authors, discordAuthor(user, ""))
+	}
+	return authors
+}
 
-	it.Pos = msg.ID
-	return (*Message)(msg), nil
+func DiscordOnMemberUpdate(fn func(guild string, author *Author)) {
+	discord.AddHandler(func(_ *discordgo.Session, event *discordgo.GuildMemberUpdate) {
+		fn(event.GuildID, discordAuthor(event.User, event.Nick))
+	})
 }
 
-func DiscordMessageForwardIt(channel string, from string) (*MessageIt, error) {
-	return &MessageIt{Channel: channel, Pos: from, direction: forward}, nil
+// Guilds are also reported along with their channels whenever a gateway
+// session is established.
+func DiscordOnGuildUpdate(fn func(guild *Guild, channels []*Channel)) {
+	discord.AddHandler(func(_ *discordgo.Session, event *discordgo.GuildCreate) {
+		channels := []*Channel{}
+		for _, channel := range event.Channels {
+			// Channels of the guild create event don't carry their guild.
+			channel := discordChannel(channel)
+			channel.GuildId = event.ID
+			channels = append(channels, channel)
+		}
+		fn(discordGuild(event.Guild), channels)
+	})
+	discord.AddHandler(func(_ *discordgo.Session, event *discordgo.GuildUpdate) {
+		fn(discordGuild(event.Guild), nil)
+	})
 }
 
-func DiscordMessageBackwardsIt(channel string, from string) (*MessageIt, error) {
-	return &MessageIt{Channel: channel, Pos: from, direction: backwards}, nil
+func DiscordOnChannelUpdate(fn func(*Channel)) {
+	discord.AddHandler(func(_ *discordgo.Session, event *discordgo.ChannelCreate) {
+		fn(discordChannel(event.Channel))
+	})
+	discord.AddHandler(func(_ *discordgo.Session, event *discordgo.ChannelUpdate) {
+		fn(discordChannel(event.Channel))
+	})
+}
+
+func DiscordOnReady(fn func()) {
+	discord.AddHandler(func(_ *discordgo.Session, _ *discordgo.Ready) { fn() })
+}
+
+func DiscordOnMessage(fn func(*Message)) {
+	discord.AddHandler(func(_ *discordgo.Session, event *discordgo.MessageCreate) {
+		fn((*Message)(event.Message))
+	})
+}
+
+func DiscordOnMessageUpdate(fn func(*Message)) {
+	discord.AddHandler(func(_ *discordgo.Session, event *discordgo.MessageUpdate) {
+		fn((*Message)(event.Message))
+	})
+}
+
+func DiscordOnMessageDelete(fn func(channel string, ids []string)) {
+	discord.AddHandler(func(_ *discordgo.Session, event *discordgo.MessageDelete) {
+		fn(event.ChannelID, []string{event.ID})
+	})
+	discord.AddHandler(func(_ *discordgo.Session, event *discordgo.MessageDeleteBulk) {
+		fn(event.ChannelID, event.Messages)
+	})
+}
+
+// Reactions are reported one user at a time with a delta of 1 when added and
+// -1 when removed.
+func DiscordOnReaction(fn func(channel, msg string, emoji *Emoji, delta int)) {
+	discord.AddHandler(func(_ *discordgo.Session, event *discordgo.MessageReactionAdd) {
+		fn(event.ChannelID, event.MessageID, (*Emoji)(&event.Emoji), 1)
+	})
+	discord.AddHandler(func(_ *discordgo.Session, event *discordgo.MessageReactionRemove) {
+		fn(event.ChannelID, event.MessageID, (*Emoji)(&event.Emoji), -1)
+	})
+}
+
+func DiscordOnReactionClear(fn func(channel, msg string)) {
+	discord.AddHandler(func(_ *discordgo.Session, event *discordgo.MessageReactionRemoveAll) {
+		fn(event.ChannelID, event.MessageID)
+	})
+}
+
+// Custom emojis are keyed by name and id while unicode emojis are their own key.
+func (emoji *Emoji) Key() string {
+	return (*discordgo.Emoji)(emoji).APIName()
+}
+
+// Snowflakes are decimal strings so a longer id is always a later id.
+func DiscordIdLess(lhs, rhs string) bool {
+	if len(lhs) != len(rhs) {
+		return len(lhs) < len(rhs)
+	}
+	return lhs < rhs
 }
 
 func DiscordTimestamp(id string) (time.Time, error) {
 	return discordgo.SnowflakeTimestamp(id)
 }
 
-func DiscordChannelName(id string) string {
+func discordChannel(channel *discordgo.Channel) *Channel {
+	return &Channel{
+		Id:       channel.ID,
+		GuildId:  channel.GuildID,
+		Name:     channel.Name,
+		Topic:    channel.Topic,
+		Nsfw:     channel.NSFW,
+		Position: channel.Position,
+		ParentId: channel.ParentID,
+	}
+}
+
+func discordGuild(guild *discordgo.Guild) *Guild {
+	return &Guild{Id: guild.ID, Name: guild.Name, Icon: guild.Icon}
+}
+
+func DiscordChannel(id string) (*Channel, error) {
 	channel, err := discord.Channel(id)
 	if err != nil {
-		Fatal("unable to fetch channel name for '%v': %v", id, err)
+		return nil, err
+	}
+	return discordChannel(channel), nil
+}
+
+func DiscordCanManageChannel(user, channel string) (bool, error) {
+	perms, err := discord.UserChannelPermissions(user, channel)
+	if err != nil {
+		return false, err
+	}
+	return perms&discordgo.PermissionManageChannels != 0, nil
+}
+
+func DiscordIsSelf(user string) bool {
+	return discord.State.User != nil && discord.State.User.ID == user
+}
+
+func DiscordSend(channel, content string) error {
+	_, err := discord.ChannelMessageSend(channel, content)
+	return err
+}
+
+func DiscordGuild(id string) (*Guild, error) {
+	guild, err := discord.Guild(id)
+	if err != nil {
+		return nil, err
+	}
+	return discordGuild(guild), nil
+}
+
+// Includes the categories which are the parents of the other channels.
+func DiscordGuildChannels(guild string) ([]*Channel, error) {
+	channels, err := discord.GuildChannels(guild)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*Channel{}
+	for _, channel := range channels {
+		result = append(result, discordChannel(channel))
+	}
+	return result, nil
+}
+
+var discordChannelMention = regexp.MustCompile(`<#(\d+)>`)
+
+// Replaces the user, role and channel mentions in the content of a message
+// with their names. Users are named by the given function such that they read
+// the same as their tags. Roles and channels are resolved from the gateway
+// state and are left untouched when they can't be found.
+func DiscordContent(guild string, msg *Message, name func(*Author) string) string {
+	pairs := []string{}
+	for _, author := range DiscordMentionAuthors(msg) {
+		pairs = append(pairs,
+			"<@"+author.Id+">", "@"+name(author),
+			"<@!"+author.Id+">", "@"+name(author))
+	}
+	for _, id := range msg.MentionRoles {
+		if role, err := discord.State.Role(guild, id); err == nil {
+			pairs = append(pairs, "<@&"+id+">", "@"+role.Name)
+		}
+	}
+	content := strings.NewReplacer(pairs...).Replace(msg.Content)
+
+	return discordChannelMention.ReplaceAllStringFunc(content, func(mention string) string {
+		channel, err := discord.State.Channel(mention[2 : len(mention)-1])
+		if err != nil {
+			return mention
+		}
+		return "#" + channel.Name
+	})
+}
+
+// The API endpoint can be overridden in the config to point at a fake Discord
+// when testing.
+func discordApi(path string) string {
+	if Config.Discord.Api != "" {
+		return Config.Discord.Api + path
+	}
+	return discordgo.EndpointAPI + path
+}
+
+// Classes of errors which determine how a failing worker recovers.
+const (
+	// Rate limits, server errors and network failures which go away on their own.
+	DiscordErrRetry = iota
+	// The channel was deleted or we lost access to it.
+	DiscordErrChannel
+	// The bot token was rejected.
+	DiscordErrAuth
+	// Anything else Discord refuses which won't change by retrying.
+	DiscordErrPermanent
+)
+
+func DiscordClassify(err error) int {
+	var rest *discordgo.RESTError
+	if !errors.As(err, &rest) || rest.Response == nil {
+		return DiscordErrRetry
+	}
+
+	code := rest.Response.StatusCode
+	switch {
+	case code == http.StatusUnauthorized:
+		return DiscordErrAuth
+	case code == http.StatusForbidden || code == http.StatusNotFound:
+		return DiscordErrChannel
+	case code == http.StatusTooManyRequests || code >= 500:
+		return DiscordErrRetry
+	default:
+		return DiscordErrPermanent
+	}
+}
+
+// Returns true if the error indicates that the requested object no longer
+// exists on Discord.
+func DiscordIsGone(err error) bool {
+	var rest *discordgo.RESTError
+	if !errors.As(err, &rest) {
+		return false
+	}
+	return rest.Response != nil && rest.Response.StatusCode == http.StatusNotFound
+}
+
+// Returns true if the error indicates that the requested message was deleted
+// as opposed to its channel.
+func DiscordIsUnknownMessage(err error) bool {
+	var rest *discordgo.RESTError
+	if !errors.As(err, &rest) {
+		return false
+	}
+	return rest.Message != nil && rest.Message.Code == discordgo.ErrCodeUnknownMessage
+}
+
+// Exchanges expired CDN attachment urls for freshly signed ones. Urls that
+// Discord doesn't know about are omitted from the result.
+func DiscordRefreshUrls(urls []string) (map[string]string, error) {
+	req := struct {
+		Urls []string `json:"attachment_urls"`
+	}{urls}
+
+	body, err := discord.RequestWithBucketID(
+		http.MethodPost, discordApi("attachments/refresh-urls"), req, discordApi("attachments/refresh-urls"))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := struct {
+		Urls []struct {
+			Original  string `json:"original"`
+			Refreshed string `json:"refreshed"`
+		} `json:"refreshed_urls"`
+	}{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	for _, url := range resp.Urls {
+		result[url.Original] = url.Refreshed
+	}
+	return result, nil
+}
+
+// Re-reads a message from the api, bypassing the state cache.
+func DiscordMessageReload(channel, msg string) (*Message, error) {
+	body, err := discord.RequestWithBucketID(
+		http.MethodGet,
+		discordApi("channels/"+channel+"/messages/"+msg),
+		nil,
+		discordApi("channels/"+channel+"/messages/"))
+	if err != nil {
+		return nil, err
+	}
+
+	message := &Message{}
+	if err := json.Unmarshal(body, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// Re-reads a message to get the current url of one of its attachment. Returns
+// an empty url if the attachment was removed from the message.
+func DiscordAttachmentUrl(channel, msg, attach string) (string, error) {
+	message, err := DiscordMessageReload(channel, msg)
+	if err != nil {
+		return "", err
+	}
+
+	for _, item := range message.Attachments {
+		if item.ID == attach {
+			return item.URL, nil
+		}
+	}
+	return "", nil
+}
+
+type Member discordgo.Member
+
+func DiscordGuildMember(guild, user string) (*Member, error) {
+	member, err := discord.State.Member(guild, user)
+	if err == nil {
+		return (*Member)(member), nil
+	}
+
+	member, err = discord.GuildMember(guild, user)
+	return (*Member)(member), err
+}
+
+// Returns an empty string if the guild isn't known to the gateway session.
+func DiscordGuildOwner(guild string) string {
+	if state, err := discord.State.Guild(guild); err == nil {
+		return state.OwnerID
 	}
-	return channel.Name
+	return ""
 }
@@ -0,0 +1,63 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Tests that need the database must be built with the sqlite_fts5 tag like the
+// binary.
+
+// Returns the path of the database such that it can be opened again.
+func testDatabase(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "archivist")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "archivist.db")
+	DatabaseOpen(file, false)
+	DatabaseMigrate(file, false)
+
+	t.Cleanup(func() {
+		DatabaseClose()
+		os.RemoveAll(dir)
+	})
+	return file
+}
+
+// Starts a fake Discord whose endpoints are registered on the returned mux by
+// the tests. Both the bot and the OAuth requests are routed to it, including
+// the ones going through the discordgo endpoints.
+func testDiscord(t *testing.T) *http.ServeMux {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+
+	saved := Config.Discord.Api
+	Config.Discord.Api = srv.URL + "/"
+
+	guilds, channels := discordgo.EndpointGuilds, discordgo.EndpointChannels
+	discordgo.EndpointGuilds = srv.URL + "/guilds/"
+	discordgo.EndpointChannels = srv.URL + "/channels/"
+
+	var err error
+	if discord, err = discordgo.New("Bot test"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		srv.Close()
+		Config.Discord.Api = saved
+		discordgo.EndpointGuilds, discordgo.EndpointChannels = guilds, channels
+	})
+	return mux
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Images are archived from the attachments of a message, from the images and
+// thumbnails of its embeds and from the links to images in its content. Images
+// that don't come from an attachment are identified by their url within a guild
+// such that an image linked multiple times is only archived once.
+
+const (
+	SourceAttachment = "attachment"
+	SourceEmbed      = "embed"
+	SourceLink       = "link"
+)
+
+type image struct {
+	id       string
+	url      string
+	filename string
+	width    int
+	height   int
+	size     int
+	source   string
+	provider string
+}
+
+var imageLinkRegex = regexp.MustCompile(`https?://[^\s<>]+`)
+
+func validAttachment(attach *Attachment) bool {
+	return validImage(attach.Filename)
+}
+
+func validImage(file string) bool {
+	file = strings.ToLower(file)
+	return strings.HasSuffix(file, ".jpg") ||
+		strings.HasSuffix(file, ".jpeg") ||
+		strings.HasSuffix(file, ".png") ||
+		strings.HasSuffix(file, ".gif")
+}
+
+func imageId(guild, raw string) string {
+	hash := sha256.Sum256([]byte(guild + " " + raw))
+	return "url:" + hex.EncodeToString(hash[:16])
+}
+
+// Names the provider of an image after the domain hosting it when the embed
+// doesn't name it: i.imgur.com becomes imgur.
+func imageProvider(raw *url.URL) string {
+	labels := strings.Split(raw.Hostname(), ".")
+	if len(labels) < 2 {
+		return raw.Hostname()
+	}
+	return labels[len(labels)-2]
+}
+
+func imageTag(provider string) string {
+	return "via:" + strings.ReplaceAll(strings.ToLower(provider), " ", "-")
+}
+
+func imageUrl(guild, raw, source, provider string, width, height int) *image {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil
+	}
+
+	if provider == "" {
+		provider = imageProvider(parsed)
+	}
+
+	return &image{
+		id:       imageId(guild, raw),
+		url:      raw,
+		filename: path.Base(parsed.Path),
+		width:    width,
+		height:   height,
+		source:   source,
+		provider: provider,
+	}
+}
+
+func images(guild string, msg *Message) []*image {
+	result := []*image{}
+	seen := make(map[string]bool)
+	add := func(img *image) {
+		if img != nil && !seen[img.id] {
+			seen[img.id] = true
+			result = append(result, img)
+		}
+	}
+
+	for _, attach := range msg.Attachments {
+		if !validAttachment((*Attachment)(attach)) {
+			continue
+		}
+
+		add(&image{
+			id:       attach.ID,
+			url:      attach.URL,
+			filename: attach.Filename,
+			width:    attach.Width,
+			height:   attach.Height,
+			size:     attach.Size,
+			source:   SourceAttachment,
+		})
+	}
+
+	// Discord puts the image of a link in the thumbnail of the embed while
+	// rich embeds may carry both in which case the image is the main one.
+	for _, embed := range msg.Embeds {
+		provider := ""
+		if embed.Provider != nil {
+			provider = embed.Provider.Name
+		}
+
+		if embed.Image != nil && embed.Image.URL != "" {
+			add(imageUrl(guild, embed.Image.URL, SourceEmbed, provider,
+				embed.Image.Width, embed.Image.Height))
+		} else if embed.Thumbnail != nil && embed.Thumbnail.URL != "" {
+			add(imageUrl(guild, embed.Thumbnail.URL, SourceEmbed, provider,
+				embed.Thumbnail.Width, embed.Thumbnail.Height))
+		}
+	}
+
+	for _, link := range imageLinkRegex.FindAllString(msg.Content, -1) {
+		if parsed, err := url.Parse(link); err == nil && validImage(parsed.Path) {
+			add(imageUrl(guild, link, SourceLink, "", 0, 0))
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// API keys let scripts and bots use the API without a browser session. Keys
+// are only displayed once when minted and only their hash is stored. They're
+// passed to the API through the `Authorization: Bearer <key>` header.
+
+const keyPrefix = "ak_"
+
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func authKey(req *http.Request) *Principal {
+	token := authBearer(req)
+	if !strings.HasPrefix(token, keyPrefix) {
+		return nil
+	}
+
+	key := DatabaseKeyByHash(keyHash(token))
+	if key == nil {
+		return nil
+	}
+
+	guilds := make(map[string]Perm)
+	for _, guild := range key.Guilds {
+		guilds[guild] = key.Perms
+	}
+
+	return &Principal{
+		Actor: fmt.Sprintf("key:%v", key.Id),
+		perms: func(guild string) Perm { return guilds[guild] },
+	}
+}
+
+func KeyMint(name string, guilds []string, perms Perm) (int64, string) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		Fatal("unable to generate key: %v", err)
+	}
+
+	key := keyPrefix + hex.EncodeToString(bytes)
+	return DatabaseKeyInsert(name, keyHash(key), guilds, perms), key
+}
+
+// Runs the key admin command requested on the command line, if any. Returns
+// true if a command was executed.
+func KeyCommand() bool {
+	switch {
+
+	case *keyMint != "":
+		guilds := []string{}
+		for _, guild := range strings.Split(*keyGuilds, ",") {
+			if guild = strings.TrimSpace(guild); guild != "" {
+				guilds = append(guilds, guild)
+			}
+		}
+		if len(guilds) == 0 {
+			Fatal("keys must be scoped to at least one guild")
+		}
+
+		perms, err := ParsePerms(strings.Split(*keyPerms, ","))
+		if err != nil {
+			Fatal("invalid key permissions '%v': %v", *keyPerms, err)
+		}
+
+		id, key := KeyMint(*keyMint, guilds, perms)
+		fmt.Printf("%v %v\n", id, key)
+
+	case *keyList:
+		for _, key := range DatabaseKeys() {
+			state := "active"
+			if key.Revoked {
+				state = "revoked"
+			}
+			fmt.Printf("%v\t%v\t%v\t%v\t%v\t%v\n",
+				key.Id, key.Name, strings.Join(key.Guilds, ","), key.Perms,
+				key.Created.Format("2006-01-02"), state)
+		}
+
+	case *keyRevoke > 0:
+		if !DatabaseKeyRevoke(*keyRevoke) {
+			Fatal("no active key with id '%v'", *keyRevoke)
+		}
+		Info("revoked key %v", *keyRevoke)
+
+	default:
+		return false
+	}
+
+	return true
+}
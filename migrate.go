@@ -0,0 +1,388 @@
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+// The database schema is versioned through sqlite's user_version pragma which
+// holds the number of migrations applied to the database. Migrations are only
+// ever appended to the list and are applied in order at startup, each within
+// its own transaction.
+
+type Migration struct {
+	Name    string
+	Queries []string
+}
+
+var migrations = []Migration{
+	{"initial schema", []string{`
+create table records (
+    id integer not null primary key autoincrement,
+    guild_id text not null,
+    chan_id text not null,
+    msg_id text not null,
+    img_id text not null,
+    time datetime not null,
+    path text not null,
+    caption text
+);`, `
+create unique index index_records_img on records(img_id);
+`, `
+create index index_records_msg on records(msg_id);
+`, `
+create index index_records_time on records(time);
+`, `
+create table tags(
+    record_id integer not null references records(id),
+    tag text not null,
+    constraint pk primary key (record_id, tag)
+);`, `
+create index index_tags_record on tags(record_id);
+`, `
+create index index_tags_tag on tags(tag);
+`, `
+create table subs (
+    chan_id text not null primary key,
+    earliest_msg_id text not null,
+    latest_msg_id text not null
+);`,
+	}},
+
+	{"record tombstones", []string{`
+alter table records add column deleted datetime;
+`,
+	}},
+
+	{"cdn url cache", []string{`
+create table urls (
+    record_id integer not null primary key references records(id),
+    url text not null,
+    expires datetime not null
+);`,
+	}},
+
+	{"caption search", []string{`
+create virtual table records_fts using fts5(caption, tags);
+`, `
+insert into records_fts(rowid, caption, tags)
+    select id, coalesce(caption, ''),
+        coalesce((select group_concat(tag, ' ') from tags where record_id = records.id), '')
+    from records;
+`,
+	}},
+
+	{"api keys", []string{`
+create table keys (
+    id integer not null primary key autoincrement,
+    name text not null,
+    hash text not null,
+    guilds text not null,
+    perms integer not null,
+    created datetime not null,
+    revoked datetime
+);`, `
+create unique index index_keys_hash on keys(hash);
+`,
+	}},
+
+	{"hidden records", []string{`
+alter table records add column hidden datetime;
+`,
+	}},
+
+	{"audit log", []string{`
+create table audit (
+    id integer not null primary key autoincrement,
+    guild_id text not null,
+    actor text not null,
+    action text not null,
+    record_id integer not null references records(id),
+    before text not null,
+    after text not null,
+    time datetime not null,
+    reverted_by integer references audit(id)
+);`, `
+create index index_audit_guild on audit(guild_id, id);
+`, `
+create index index_audit_record on audit(record_id);
+`,
+	}},
+
+	{"record metadata", []string{`
+alter table records add column author_id text;
+`, `
+alter table records add column filename text;
+`, `
+alter table records add column width integer;
+`, `
+alter table records add column height integer;
+`, `
+alter table records add column size integer;
+`,
+	}},
+
+	{"reactions", []string{`
+create table reactions (
+  record_id integer not null references records(id),
+  emoji text not null,
+  count integer not null,
+  primary key (record_id, emoji)
+);
+`, `
+alter table records add column popularity integer not null default 0;
+`, `
+create index index_records_popular on records(guild_id, popularity, id);
+`,
+	}},
+
+	{"authors", []string{`
+create table authors (
+  guild_id text not null,
+  id text not null,
+  username text not null,
+  nickname text,
+  avatar text,
+  updated datetime not null,
+  primary key (guild_id, id)
+);
+`, `
+create table author_history (
+  guild_id text not null,
+  author_id text not null,
+  username text not null,
+  nickname text,
+  time datetime not null
+);
+`, `
+create index index_author_history on author_history(guild_id, author_id);
+`, `
+create index index_records_author on records(guild_id, author_id);
+`, `
+-- Seeds the authors of the records that already carry an author id from the
+-- author tag of their latest record, which is the first @ tag it was ingested
+-- with. The bare columns of an aggregate come from the row of the max().
+insert into authors(guild_id, id, username, updated)
+  select guild_id, author_id, username, updated from (
+    select guild_id, author_id, max(time) as updated,
+      (select substr(tag, 2) from tags
+        where record_id = records.id and substr(tag, 1, 1) = '@'
+        order by rowid asc limit 1) as username
+    from records where author_id is not null and author_id != ''
+    group by guild_id, author_id)
+  where username is not null;
+`, `
+insert into author_history(guild_id, author_id, username, time)
+  select guild_id, id, username, updated from authors;
+`,
+	}},
+
+	{"guilds and channels", []string{`
+create table guilds (
+  id text primary key,
+  name text not null,
+  icon text,
+  updated datetime not null
+);
+`, `
+create table channels (
+  id text primary key,
+  guild_id text not null,
+  name text not null,
+  topic text,
+  nsfw integer not null default 0,
+  position integer not null default 0,
+  parent_id text,
+  updated datetime not null
+);
+`, `
+create index index_channels_guild on channels(guild_id);
+`, `
+create index index_records_chan on records(chan_id);
+`,
+	}},
+
+	{"managed subs", []string{`
+alter table subs add column guild_id text;
+`, `
+alter table subs add column enabled integer not null default 1;
+`, `
+alter table subs add column options text not null default '{}';
+`, `
+update subs set guild_id = (select guild_id from records where chan_id = subs.chan_id limit 1);
+`,
+	}},
+
+	{"sub state", []string{`
+alter table subs add column state text not null default '';
+`, `
+alter table subs add column error text;
+`, `
+alter table subs add column state_time datetime;
+`,
+	}},
+
+	{"record sources", []string{`
+alter table records add column source text not null default 'attachment';
+`,
+	}},
+
+	{"record links", []string{`
+create table links (
+  record_id integer not null references records(id),
+  chan_id text not null,
+  msg_id text not null,
+  constraint pk primary key (record_id, msg_id)
+);
+`, `
+create index index_links_msg on links(msg_id);
+`, `
+insert into links(record_id, chan_id, msg_id)
+  select id, chan_id, msg_id from records where source != 'attachment';
+`,
+	}},
+
+	{"audit reverts", []string{`
+alter table audit add column reverts integer references audit(id);
+`, `
+create index index_audit_reverts on audit(reverts);
+`, `
+-- The audit table is append-only so a revert points to the entry it reverts
+-- instead of marking it. reverted_by is left in place but no longer written.
+update audit set reverts = (select reverted.id from audit as reverted where reverted.reverted_by = audit.id)
+  where id in (select reverted_by from audit where reverted_by is not null);
+`,
+	}},
+
+	{"author tags", []string{`
+alter table authors add column tag text;
+`, `
+update authors set tag = coalesce(nickname, username);
+`, `
+-- Authors sharing a display name within a guild are told apart by the end of
+-- their id while the first one seen keeps the plain name.
+update authors set tag = tag || '~' || substr(id, -4)
+  where exists (select 1 from authors as other
+    where other.guild_id = authors.guild_id and other.tag = authors.tag and other.rowid < authors.rowid);
+`, `
+-- The records of the renamed authors are retagged along with their search
+-- index entries. These rewrites predate the audit of the scraper's changes.
+insert or ignore into tags(record_id, tag)
+  select tags.record_id, '@' || authors.tag from tags
+    join records on records.id = tags.record_id
+    join authors on authors.guild_id = records.guild_id and authors.id = records.author_id
+  where authors.tag != coalesce(authors.nickname, authors.username)
+    and tags.tag = '@' || coalesce(authors.nickname, authors.username);
+`, `
+delete from tags where rowid in (
+  select tags.rowid from tags
+    join records on records.id = tags.record_id
+    join authors on authors.guild_id = records.guild_id and authors.id = records.author_id
+  where authors.tag != coalesce(authors.nickname, authors.username)
+    and tags.tag = '@' || coalesce(authors.nickname, authors.username));
+`, `
+delete from records_fts where rowid in (
+  select records.id from records
+    join authors on authors.guild_id = records.guild_id and authors.id = records.author_id
+  where authors.tag != coalesce(authors.nickname, authors.username));
+`, `
+insert into records_fts(rowid, caption, tags)
+  select id, coalesce(caption, ''),
+    coalesce((select group_concat(tag, ' ') from tags where record_id = records.id), '')
+  from records where id in (
+    select records.id from records
+      join authors on authors.guild_id = records.guild_id and authors.id = records.author_id
+    where authors.tag != coalesce(authors.nickname, authors.username));
+`,
+	}},
+
+	{"checkpoints", []string{`
+-- Progress of the background jobs that walk over the archive such that they
+-- resume where they left off after a restart.
+create table checkpoints (
+  name text primary key,
+  value integer not null
+);
+`,
+	}},
+}
+
+func migrateVersion() int {
+	const query = "pragma user_version;"
+	rows, err := db.Query(query)
+	defer rows.Close()
+	check(err, query)
+
+	var version int
+	rows.Next()
+	check(rows.Scan(&version), query)
+
+	// Databases created before the schema was versioned only contain the
+	// initial schema.
+	if version == 0 {
+		const query = "select count(*) from sqlite_master where type = 'table' and name = 'records';"
+		rows, err := db.Query(query)
+		defer rows.Close()
+		check(err, query)
+
+		var count int
+		rows.Next()
+		check(rows.Scan(&count), query)
+
+		if count > 0 {
+			version = 1
+		}
+	}
+
+	return version
+}
+
+func migrate(version int) {
+	migration := migrations[version-1]
+
+	tx, err := db.Begin()
+	check(err, "begin")
+
+	for _, query := range migration.Queries {
+		_, err := tx.Exec(query)
+		check(err, query)
+	}
+
+	// Pragmas can't be parameterized.
+	query := "pragma user_version = " + strconv.Itoa(version) + ";"
+	_, err = tx.Exec(query)
+	check(err, query)
+
+	check(tx.Commit(), "commit")
+}
+
+// Pending migrations are only listed when dryRun is set. A database that is
+// more recent than the binary is never touched as it's not possible to know
+// whether it's still compatible.
+func DatabaseMigrate(file string, dryRun bool) {
+	if _, err := os.Stat(file); err != nil && dryRun {
+		for i, migration := range migrations {
+			Info("migration %v pending: %v", i+1, migration.Name)
+		}
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	version := migrateVersion()
+	if version > len(migrations) {
+		Fatal("database '%v' is at version %v which is more recent than the supported version %v",
+			file, version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if dryRun {
+			Info("migration %v pending: %v", i+1, migrations[i].Name)
+			continue
+		}
+
+		migrate(i + 1)
+		Info("migration %v applied: %v", i+1, migrations[i].Name)
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/url"
 	"strconv"
 	"strings"
@@ -15,78 +19,261 @@ type Stats struct {
 }
 
 type Record struct {
-	Id        int64     `json:"id"`
-	GuildId   string    `json:"guild"`
-	ChannelId string    `json:"channel"`
-	MessageId string    `json:"message"`
-	ImageId   string    `json:"image"`
-	Time      time.Time `json:"time"`
-	Path      string    `json:"path"`
-	Caption   string    `json:"caption"`
-	Tags      []string  `json:"tags"`
+	Id        int64          `json:"id"`
+	GuildId   string         `json:"guild"`
+	ChannelId string         `json:"channel"`
+	MessageId string         `json:"message"`
+	ImageId   string         `json:"image"`
+	Source    string         `json:"source"`
+	Time      time.Time      `json:"time"`
+	Path      string         `json:"path"`
+	Caption   string         `json:"caption"`
+	AuthorId  string         `json:"author"`
+	Filename  string         `json:"filename"`
+	Width     int            `json:"width"`
+	Height    int            `json:"height"`
+	Size      int            `json:"size"`
+	Tags      []string       `json:"tags"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+	Deleted   bool           `json:"-"`
+	Hidden    bool           `json:"hidden,omitempty"`
 }
 
-// /api/query/<guild>?from=<[msg|img]:<id>>&limit=<int>&tags=<tag,tag,tag>
+type Author struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+	Nickname string `json:"nickname,omitempty"`
+	Avatar   string `json:"avatar,omitempty"`
 
-type QueryId struct {
-	Column string
-	Id     string
+	// The name the author's records are tagged with which is the display name
+	// unless it's already taken by another author of the guild.
+	Tag string `json:"tag,omitempty"`
 }
 
-func (id QueryId) IsSet() bool {
-	return id.Column != ""
+// The name displayed in the guild and used to tag the author's records.
+func (author *Author) Name() string {
+	if author.Nickname != "" {
+		return author.Nickname
+	}
+	return author.Username
+}
+
+// Subscriptions to the channels to archive. Disabled subscriptions keep their
+// progress such that they resume where they left off when enabled again.
+type Subscription struct {
+	Guild    string     `json:"guild"`
+	Channel  string     `json:"channel"`
+	Enabled  bool       `json:"enabled"`
+	Options  SubOptions `json:"options"`
+	Earliest string     `json:"earliest"`
+	Latest   string     `json:"latest"`
+	State    string     `json:"state,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// Errored subs are retried while paused subs stay stopped until they're
+// subscribed again.
+const (
+	SubHealthy = ""
+	SubErrored = "errored"
+	SubPaused  = "paused"
+)
+
+type SubOptions struct {
+	// Only archive the messages posted after the subscription was created.
+	SkipBackfill bool `json:"skip_backfill,omitempty"`
+}
+
+type Guild struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Icon string `json:"icon,omitempty"`
+}
+
+type Channel struct {
+	Id       string `json:"id"`
+	GuildId  string `json:"guild"`
+	Name     string `json:"name"`
+	Topic    string `json:"topic,omitempty"`
+	Nsfw     bool   `json:"nsfw"`
+	Position int    `json:"position"`
+	ParentId string `json:"parent,omitempty"`
+}
+
+type Key struct {
+	Id      int64     `json:"id"`
+	Name    string    `json:"name"`
+	Guilds  []string  `json:"guilds"`
+	Perms   Perm      `json:"perms"`
+	Created time.Time `json:"created"`
+	Revoked bool      `json:"revoked"`
+}
+
+type AuditEntry struct {
+	Id         int64           `json:"id"`
+	GuildId    string          `json:"guild"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	RecordId   int64           `json:"record"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	Time       time.Time       `json:"time"`
+	Reverts    int64           `json:"reverts,omitempty"`
+	RevertedBy int64           `json:"reverted_by,omitempty"`
+}
+
+// /api/audit/<guild>?record=<id>&actor=<actor>&action=<action>&before=<id>&limit=<int>
+
+type AuditQuery struct {
+	GuildId  string
+	RecordId int64
+	Actor    string
+	Action   string
+	Before   int64
+	Limit    int64
+}
+
+func NewAuditQuery(guild string, url *url.URL) (AuditQuery, error) {
+	query := AuditQuery{GuildId: guild, Limit: 50}
+	qs := url.Query()
+
+	for _, param := range []struct {
+		name  string
+		value *int64
+	}{{"record", &query.RecordId}, {"before", &query.Before}, {"limit", &query.Limit}} {
+		raw := qs.Get(param.name)
+		if raw == "" {
+			continue
+		}
+
+		value, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || value <= 0 {
+			return AuditQuery{}, fmt.Errorf("invalid %v '%v'", param.name, raw)
+		}
+		*param.value = value
+	}
+
+	if query.Limit > 500 {
+		query.Limit = 500
+	}
+
+	query.Actor = qs.Get("actor")
+	query.Action = qs.Get("action")
+	return query, nil
 }
 
+// /api/query/<guild>?cursor=<token>&limit=<int>&tags=<expr>&q=<search>&sort=<time|rank|popular>&embed=<bool>
+
+const (
+	SortTime    = "time"
+	SortRank    = "rank"
+	SortPopular = "popular"
+)
+
 type Query struct {
 	GuildId string
-	Tag     string
-	From    QueryId
-	Since   QueryId
+	Tags    *TagExpr
+	Search  string
+	Sort    string
+	Cursor  *Cursor
 	Limit   int64
+	Embed   bool
 }
 
-func (Query) parseGuild(path string) (bool, string) {
-	items := strings.Split(path, "/")
-	if len(items) != 4 || items[2] != "query" {
-		return false, ""
-	}
+type QueryResult struct {
+	Ids     []int64   `json:"ids"`
+	Records []*Record `json:"records,omitempty"`
+	Next    string    `json:"next,omitempty"`
+	Prev    string    `json:"prev,omitempty"`
+}
 
-	guild := items[3]
-	if _, err := strconv.ParseInt(guild, 10, 64); err != nil {
-		return false, ""
+const (
+	CursorNext = "next"
+	CursorPrev = "prev"
+)
+
+// Cursors are opaque tokens handed out with query results that mark the
+// position of a record within the sort order of the query. Pages are fetched
+// relative to the key of the record such that records inserted or removed in
+// between requests never cause a record to be skipped or duplicated.
+type Cursor struct {
+	Sort       string
+	Dir        string
+	Time       time.Time
+	Rank       float64
+	Popularity int64
+	Id         int64
+}
+
+func (cursor Cursor) String() string {
+	key := ""
+	switch cursor.Sort {
+	case SortTime:
+		key = strconv.FormatInt(cursor.Time.UnixNano(), 10)
+	case SortRank:
+		key = strconv.FormatFloat(cursor.Rank, 'g', -1, 64)
+	case SortPopular:
+		key = strconv.FormatInt(cursor.Popularity, 10)
 	}
 
-	return true, guild
+	raw := strings.Join([]string{cursor.Sort, cursor.Dir, key, strconv.FormatInt(cursor.Id, 10)}, ":")
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
 }
 
-func (Query) parseId(raw string) (bool, QueryId) {
-	if raw == "" {
-		return true, QueryId{}
+func ParseCursor(token string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+
+	items := strings.Split(string(raw), ":")
+	if len(items) != 4 {
+		return nil, errors.New("malformed cursor")
 	}
 
-	items := strings.Split(raw, ":")
-	if len(items) != 2 {
-		return false, QueryId{}
+	cursor := &Cursor{Sort: items[0], Dir: items[1]}
+	if cursor.Dir != CursorNext && cursor.Dir != CursorPrev {
+		return nil, errors.New("malformed cursor direction")
 	}
 
-	var column string
-	switch items[0] {
-	case "msg":
-		column = "msg_id"
-	case "img":
-		column = "img_id"
-	case "chan":
-		column = "chan_id"
+	switch cursor.Sort {
+	case SortTime:
+		ns, err := strconv.ParseInt(items[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		cursor.Time = time.Unix(0, ns)
+	case SortRank:
+		if cursor.Rank, err = strconv.ParseFloat(items[2], 64); err != nil {
+			return nil, err
+		}
+	case SortPopular:
+		if cursor.Popularity, err = strconv.ParseInt(items[2], 10, 64); err != nil {
+			return nil, err
+		}
 	default:
-		return false, QueryId{}
+		return nil, errors.New("malformed cursor sort")
 	}
 
-	id := items[1]
-	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
-		return false, QueryId{}
+	if cursor.Id, err = strconv.ParseInt(items[3], 10, 64); err != nil {
+		return nil, err
 	}
 
-	return true, QueryId{column, id}
+	return cursor, nil
+}
+
+func (Query) parseGuild(path string) (bool, string) {
+	items := strings.Split(path, "/")
+	if len(items) != 4 || items[2] != "query" {
+		return false, ""
+	}
+
+	guild := items[3]
+	if _, err := strconv.ParseInt(guild, 10, 64); err != nil {
+		return false, ""
+	}
+
+	return true, guild
 }
 
 func (Query) parseInt(raw string) (bool, int64) {
@@ -108,50 +295,164 @@ func (Query) parseTag(tag string) (bool, string) {
 	return true, tag
 }
 
-func NewQuery(url *url.URL) (bool, Query) {
+// Translates a user search into an fts5 query where every term must match.
+// Quoted terms are matched as phrases and terms ending with '*' are matched as
+// prefixes. Everything else gets quoted to keep the fts5 syntax out of reach.
+func (Query) parseSearch(raw string) (bool, string) {
+	if n := len(raw); n == 0 {
+		return true, ""
+	} else if n > 200 {
+		return false, ""
+	}
+
+	quote := func(term string) string {
+		return `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+
+	terms := []string{}
+	for i := 0; i < len(raw); {
+		if raw[i] == ' ' || raw[i] == '\t' {
+			i++
+			continue
+		}
+
+		var term string
+		if raw[i] == '"' {
+			end := strings.IndexByte(raw[i+1:], '"')
+			if end < 0 {
+				return false, ""
+			}
+			term = raw[i+1 : i+1+end]
+			i += end + 2
+		} else {
+			end := strings.IndexAny(raw[i:], " \t\"")
+			if end < 0 {
+				end = len(raw) - i
+			}
+			term = raw[i : i+end]
+			i += end
+		}
+
+		prefix := strings.HasSuffix(term, "*")
+		if i < len(raw) && raw[i] == '*' {
+			prefix = true
+			i++
+		}
+
+		term = strings.TrimSpace(strings.TrimRight(term, "*"))
+		if term == "" {
+			continue
+		}
+
+		if prefix {
+			terms = append(terms, quote(term)+"*")
+		} else {
+			terms = append(terms, quote(term))
+		}
+	}
+
+	if len(terms) == 0 {
+		return true, ""
+	}
+	return true, strings.Join(terms, " ")
+}
+
+func (query Query) parseSort(raw string) (bool, string) {
+	switch raw {
+	case "":
+		if query.HasSearch() {
+			return true, SortRank
+		}
+		return true, SortTime
+	case SortTime:
+		return true, SortTime
+	case SortRank:
+		return query.HasSearch(), SortRank
+	case SortPopular:
+		return true, SortPopular
+	default:
+		return false, ""
+	}
+}
+
+var errQueryPath = errors.New("invalid query path")
+
+func NewQuery(url *url.URL) (Query, error) {
 	query := Query{}
 	qs := url.Query()
 
 	if ok, guild := query.parseGuild(url.Path); ok {
 		query.GuildId = guild
 	} else {
-		return false, Query{}
+		return Query{}, errQueryPath
 	}
 
-	if ok, id := query.parseId(qs.Get("from")); ok {
-		query.From = id
+	if ok, limit := query.parseInt(qs.Get("limit")); ok && limit > 0 {
+		query.Limit = limit
 	} else {
-		return false, Query{}
+		query.Limit = 20
 	}
 
-	if ok, id := query.parseId(qs.Get("since")); ok {
-		query.From = id
-	} else {
-		return false, Query{}
+	// Embedded records are fetched in a single batch.
+	if query.Limit > recordsMaxIds {
+		query.Limit = recordsMaxIds
 	}
 
-	if ok, limit := query.parseInt(qs.Get("limit")); ok && limit > 0 {
-		query.Limit = limit
+	if ok, tag := query.parseTag(qs.Get("tag")); !ok {
+		return Query{}, fmt.Errorf("invalid tag '%v'", qs.Get("tag"))
+	} else if tag != "" {
+		query.Tags = &TagExpr{Op: TagOpTag, Tag: tag}
+	}
+
+	if expr, err := ParseTagExpr(qs.Get("tags")); err != nil {
+		return Query{}, fmt.Errorf("invalid tags: %v", err)
+	} else if expr != nil && query.Tags != nil {
+		query.Tags = &TagExpr{Op: TagOpAnd, Args: []*TagExpr{query.Tags, expr}}
+	} else if expr != nil {
+		query.Tags = expr
+	}
+
+	if ok, search := query.parseSearch(qs.Get("q")); ok {
+		query.Search = search
 	} else {
-		query.Limit = 20
+		return Query{}, fmt.Errorf("invalid search '%v'", qs.Get("q"))
 	}
 
-	if ok, tag := query.parseTag(qs.Get("tag")); ok {
-		query.Tag = tag
+	if ok, sort := query.parseSort(qs.Get("sort")); ok {
+		query.Sort = sort
 	} else {
-		return false, Query{}
+		return Query{}, fmt.Errorf("invalid sort '%v'", qs.Get("sort"))
+	}
+
+	if raw := qs.Get("embed"); raw != "" {
+		if embed, err := strconv.ParseBool(raw); err != nil {
+			return Query{}, fmt.Errorf("invalid embed '%v'", raw)
+		} else {
+			query.Embed = embed
+		}
 	}
 
-	return true, query
+	if raw := qs.Get("cursor"); raw != "" {
+		if cursor, err := ParseCursor(raw); err != nil {
+			return Query{}, fmt.Errorf("invalid cursor: %v", err)
+		} else if cursor.Sort != query.Sort {
+			return Query{}, fmt.Errorf("cursor doesn't match sort '%v'", query.Sort)
+		} else {
+			query.Cursor = cursor
+		}
+	}
+
+	return query, nil
 }
 
-func (query Query) HasFrom() bool {
-	return query.From.IsSet()
+func (query Query) HasCursor() bool {
+	return query.Cursor != nil
 }
-func (query Query) HasSince() bool {
-	return query.From.IsSet()
+
+func (query Query) HasTags() bool {
+	return query.Tags != nil
 }
 
-func (query Query) HasTag() bool {
-	return query.Tag != ""
+func (query Query) HasSearch() bool {
+	return query.Search != ""
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []Cursor{
+		{Sort: SortTime, Dir: CursorNext, Time: time.Unix(1592000000, 123456789), Id: 42},
+		{Sort: SortTime, Dir: CursorPrev, Time: time.Unix(0, 0), Id: 1},
+		{Sort: SortRank, Dir: CursorNext, Rank: -3.25, Id: 7},
+		{Sort: SortRank, Dir: CursorPrev, Rank: 1e-9, Id: 8},
+		{Sort: SortPopular, Dir: CursorNext, Popularity: 12, Id: 9},
+		{Sort: SortPopular, Dir: CursorPrev, Popularity: 0, Id: 10},
+	}
+
+	for _, test := range tests {
+		token := test.String()
+		cursor, err := ParseCursor(token)
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", test, err)
+			continue
+		}
+
+		if cursor.Sort != test.Sort || cursor.Dir != test.Dir || cursor.Id != test.Id ||
+			!cursor.Time.Equal(test.Time) || cursor.Rank != test.Rank ||
+			cursor.Popularity != test.Popularity {
+			t.Errorf("%+v: round trip gave %+v", test, *cursor)
+		}
+	}
+}
+
+func TestParseCursorErrors(t *testing.T) {
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+
+	tests := []string{
+		"",
+		"!!!",
+		encode("time:next:1"),
+		encode("time:next:1:2:3"),
+		encode("time:up:1:2"),
+		encode("size:next:1:2"),
+		encode("time:next:abc:2"),
+		encode("rank:next:abc:2"),
+		encode("popular:next:1.5:2"),
+		encode("time:next:1:abc"),
+	}
+
+	for _, token := range tests {
+		if cursor, err := ParseCursor(token); err == nil {
+			t.Errorf("%q: expected an error, got %+v", token, *cursor)
+		}
+	}
+}
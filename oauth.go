@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Users log in through Discord's OAuth2 authorization code flow. The only thing
+// we keep from the exchange is the user's identity and the archived guilds it's
+// a member of which are stored in a signed session cookie. The access token is
+// thrown away right after the login.
+//
+// All the OAuth endpoints are derived from the Discord API endpoint which can be
+// pointed at a local fake provider.
+
+const (
+	sessionCookie   = "archivist_session"
+	stateCookie     = "archivist_state"
+	sessionDuration = 7 * 24 * time.Hour
+	stateDuration   = 10 * time.Minute
+)
+
+var sessionKey []byte
+
+var oauthClient = &http.Client{Timeout: 20 * time.Second}
+
+type Session struct {
+	UserId  string    `json:"user"`
+	Name    string    `json:"name"`
+	Guilds  []string  `json:"guilds"`
+	Expires time.Time `json:"expires"`
+}
+
+func OauthEnabled() bool {
+	return Config.Auth.ClientId != ""
+}
+
+func OauthInit() {
+	if !OauthEnabled() {
+		Warning("discord login not configured; all guilds are public")
+		return
+	}
+
+	if Config.Auth.SessionKey != "" {
+		sessionKey = []byte(Config.Auth.SessionKey)
+	} else {
+		Warning("no session key configured; sessions won't survive restarts")
+		sessionKey = make([]byte, 32)
+		if _, err := rand.Read(sessionKey); err != nil {
+			Fatal("unable to generate session key: %v", err)
+		}
+	}
+
+	http.HandleFunc("/login", wrap(limit("login", oauthLogin)))
+	http.HandleFunc("/login/callback", wrap(limit("login", oauthCallback)))
+	http.HandleFunc("/logout", wrap(oauthLogout))
+}
+
+func sessionSign(payload string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func sessionEncode(session *Session) (string, error) {
+	bytes, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(bytes)
+	return payload + "." + sessionSign(payload), nil
+}
+
+func sessionDecode(raw string) *Session {
+	items := strings.Split(raw, ".")
+	if len(items) != 2 {
+		return nil
+	}
+
+	if !hmac.Equal([]byte(items[1]), []byte(sessionSign(items[0]))) {
+		return nil
+	}
+
+	bytes, err := base64.RawURLEncoding.DecodeString(items[0])
+	if err != nil {
+		return nil
+	}
+
+	session := &Session{}
+	if err := json.Unmarshal(bytes, session); err != nil {
+		return nil
+	}
+
+	if time.Now().After(session.Expires) {
+		return nil
+	}
+
+	return session
+}
+
+func SessionGet(req *http.Request) *Session {
+	if !OauthEnabled() {
+		return nil
+	}
+
+	cookie, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	return sessionDecode(cookie.Value)
+}
+
+func setCookie(writer http.ResponseWriter, name, value string, expires time.Time) {
+	http.SetCookie(writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   Config.Http.BindTls != "",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Only local paths are accepted to avoid turning the login into an open
+// redirect.
+func oauthNext(raw string) string {
+	if !strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "//") || strings.HasPrefix(raw, "/\\") {
+		return "/"
+	}
+	return raw
+}
+
+func oauthLogin(writer http.ResponseWriter, req *http.Request) int {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		Warning("unable to generate oauth state: %v", err)
+		return respCode(http.StatusInternalServerError, writer, req)
+	}
+
+	state := hex.EncodeToString(nonce)
+	next := oauthNext(req.URL.Query().Get("next"))
+	setCookie(writer, stateCookie, state+"|"+next, time.Now().Add(stateDuration))
+
+	qs := url.Values{}
+	qs.Set("client_id", Config.Auth.ClientId)
+	qs.Set("redirect_uri", Config.Auth.RedirectUrl)
+	qs.Set("response_type", "code")
+	qs.Set("scope", "identify guilds")
+	qs.Set("state", state)
+
+	http.Redirect(writer, req, discordApi("oauth2/authorize")+"?"+qs.Encode(), http.StatusFound)
+	return http.StatusFound
+}
+
+func oauthGet(token, path string, value interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, discordApi(path), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v returned %v: %s", path, resp.StatusCode, body)
+	}
+	return json.Unmarshal(body, value)
+}
+
+func oauthExchange(code string) (string, error) {
+	form := url.Values{}
+	form.Set("client_id", Config.Auth.ClientId)
+	form.Set("client_secret", Config.Auth.ClientSecret)
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", Config.Auth.RedirectUrl)
+	form.Set("scope", "identify guilds")
+
+	resp, err := oauthClient.PostForm(discordApi("oauth2/token"), form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token exchange returned %v: %s", resp.StatusCode, body)
+	}
+
+	token := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("token exchange returned no access token")
+	}
+
+	return token.AccessToken, nil
+}
+
+func oauthSession(token string) (*Session, error) {
+	user := struct {
+		Id       string `json:"id"`
+		Username string `json:"username"`
+	}{}
+	if err := oauthGet(token, "users/@me", &user); err != nil {
+		return nil, err
+	}
+
+	guilds := []struct {
+		Id string `json:"id"`
+	}{}
+	if err := oauthGet(token, "users/@me/guilds", &guilds); err != nil {
+		return nil, err
+	}
+
+	// Only keep the guilds we archive to keep the cookie small.
+	session := &Session{
+		UserId:  user.Id,
+		Name:    user.Username,
+		Guilds:  []string{},
+		Expires: time.Now().Add(sessionDuration),
+	}
+	archived := make(map[string]bool)
+	for _, guild := range DatabaseSubGuilds() {
+		archived[guild] = true
+	}
+	for _, guild := range guilds {
+		if archived[guild.Id] {
+			session.Guilds = append(session.Guilds, guild.Id)
+		}
+	}
+
+	return session, nil
+}
+
+func oauthCallback(writer http.ResponseWriter, req *http.Request) int {
+	cookie, err := req.Cookie(stateCookie)
+	if err != nil {
+		return respError(http.StatusBadRequest, errors.New("missing login state"), writer, req)
+	}
+	setCookie(writer, stateCookie, "", time.Unix(0, 0))
+
+	items := strings.SplitN(cookie.Value, "|", 2)
+	qs := req.URL.Query()
+	if len(items) != 2 || items[0] == "" || !hmac.Equal([]byte(items[0]), []byte(qs.Get("state"))) {
+		return respError(http.StatusBadRequest, errors.New("invalid login state"), writer, req)
+	}
+
+	if qs.Get("error") != "" {
+		return respError(http.StatusForbidden, fmt.Errorf("login refused: %v", qs.Get("error")), writer, req)
+	}
+
+	token, err := oauthExchange(qs.Get("code"))
+	if err != nil {
+		Warning("unable to exchange oauth code: %v", err)
+		return respCode(http.StatusBadGateway, writer, req)
+	}
+
+	session, err := oauthSession(token)
+	if err != nil {
+		Warning("unable to fetch oauth user: %v", err)
+		return respCode(http.StatusBadGateway, writer, req)
+	}
+
+	value, err := sessionEncode(session)
+	if err != nil {
+		Warning("unable to encode session: %v", err)
+		return respCode(http.StatusInternalServerError, writer, req)
+	}
+	setCookie(writer, sessionCookie, value, session.Expires)
+
+	Info("login user:%v guilds:%v", session.UserId, session.Guilds)
+	http.Redirect(writer, req, oauthNext(items[1]), http.StatusFound)
+	return http.StatusFound
+}
+
+func oauthLogout(writer http.ResponseWriter, req *http.Request) int {
+	setCookie(writer, sessionCookie, "", time.Unix(0, 0))
+	http.Redirect(writer, req, "/", http.StatusFound)
+	return http.StatusFound
+}
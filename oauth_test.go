@@ -0,0 +1,95 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestOauthCallback(t *testing.T) {
+	testDatabase(t)
+	mux := testDiscord(t)
+
+	saved := Config.Auth
+	defer func() { Config.Auth = saved }()
+	Config.Auth.ClientId = "client"
+	Config.Auth.ClientSecret = "secret"
+	sessionKey = []byte("key")
+
+	// Only the archived guilds make it into the session.
+	DatabaseSubSeed("1", "10")
+	DatabaseSubSeed("2", "20")
+
+	mux.HandleFunc("/oauth2/token", func(writer http.ResponseWriter, req *http.Request) {
+		if req.FormValue("code") != "good" || req.FormValue("client_secret") != "secret" {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(writer).Encode(map[string]string{"access_token": "token"})
+	})
+
+	user := func(value interface{}) http.HandlerFunc {
+		return func(writer http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Authorization") != "Bearer token" {
+				writer.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(writer).Encode(value)
+		}
+	}
+	mux.Handle("/users/@me", user(map[string]string{"id": "7", "username": "bob"}))
+	mux.Handle("/users/@me/guilds", user([]map[string]string{{"id": "1"}, {"id": "2"}, {"id": "3"}}))
+
+	tests := []struct {
+		name     string
+		state    string
+		query    string
+		code     int
+		location string
+	}{
+		{"missing state", "", "?state=abc&code=good", http.StatusBadRequest, ""},
+		{"mismatched state", "abc|/", "?state=xyz&code=good", http.StatusBadRequest, ""},
+		{"empty state", "|/", "?state=&code=good", http.StatusBadRequest, ""},
+		{"refused", "abc|/", "?state=abc&error=access_denied", http.StatusForbidden, ""},
+		{"bad code", "abc|/", "?state=abc&code=bad", http.StatusBadGateway, ""},
+		{"login", "abc|/gallery/1", "?state=abc&code=good", http.StatusFound, "/gallery/1"},
+		{"open redirect", "abc|//evil.com", "?state=abc&code=good", http.StatusFound, "/"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/login/callback"+test.query, nil)
+		if test.state != "" {
+			req.AddCookie(&http.Cookie{Name: stateCookie, Value: test.state})
+		}
+
+		writer := httptest.NewRecorder()
+		if code := oauthCallback(writer, req); code != test.code || writer.Code != test.code {
+			t.Errorf("%v: got %v/%v, expected %v", test.name, code, writer.Code, test.code)
+			continue
+		}
+		if test.code != http.StatusFound {
+			continue
+		}
+
+		if location := writer.Header().Get("Location"); location != test.location {
+			t.Errorf("%v: redirected to %q, expected %q", test.name, location, test.location)
+		}
+
+		var session *Session
+		for _, cookie := range writer.Result().Cookies() {
+			if cookie.Name == sessionCookie {
+				session = sessionDecode(cookie.Value)
+			}
+		}
+		if session == nil {
+			t.Errorf("%v: no valid session cookie", test.name)
+		} else if session.UserId != "7" || !reflect.DeepEqual(session.Guilds, []string{"1", "2"}) {
+			t.Errorf("%v: unexpected session %+v", test.name, *session)
+		}
+	}
+}
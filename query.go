@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Boolean tag expressions used to filter queries:
+//
+//   expr  := or
+//   or    := and { ("OR" | "|") and }
+//   and   := unary { ["AND" | "&" | ","] unary }
+//   unary := ("NOT" | "!") unary | "(" expr ")" | tag | '"' tag '"'
+//
+// Terms that are juxtaposed are implicitly joined with AND which makes the
+// plain `tag,tag,tag` form a conjunction. Tags containing spaces, reserved
+// characters or that collide with a keyword must be quoted.
+
+const (
+	tagExprMaxTerms = 32
+	tagExprMaxDepth = 16
+)
+
+const (
+	TagOpTag = iota
+	TagOpAnd
+	TagOpOr
+	TagOpNot
+)
+
+type TagExpr struct {
+	Op   int
+	Tag  string
+	Args []*TagExpr
+}
+
+const (
+	tokTag = iota
+	tokAnd
+	tokOr
+	tokNot
+	tokOpen
+	tokClose
+	tokEnd
+)
+
+type tagToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+type tagParser struct {
+	tokens []tagToken
+	index  int
+	terms  int
+	depth  int
+}
+
+func tagLex(raw string) ([]tagToken, error) {
+	tokens := []tagToken{}
+
+	for i := 0; i < len(raw); {
+		switch c := raw[i]; c {
+		case ' ', '\t', '\n':
+			i++
+		case '(':
+			tokens = append(tokens, tagToken{tokOpen, "(", i})
+			i++
+		case ')':
+			tokens = append(tokens, tagToken{tokClose, ")", i})
+			i++
+		case '&', ',':
+			tokens = append(tokens, tagToken{tokAnd, string(c), i})
+			i++
+		case '|':
+			tokens = append(tokens, tagToken{tokOr, "|", i})
+			i++
+		case '!':
+			tokens = append(tokens, tagToken{tokNot, "!", i})
+			i++
+
+		case '"':
+			end := strings.IndexByte(raw[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote at %v", i)
+			}
+			tokens = append(tokens, tagToken{tokTag, raw[i+1 : i+1+end], i})
+			i += end + 2
+
+		default:
+			end := strings.IndexAny(raw[i:], " \t\n()&,|!\"")
+			if end < 0 {
+				end = len(raw) - i
+			}
+			word := raw[i : i+end]
+
+			kind := tokTag
+			switch word {
+			case "AND":
+				kind = tokAnd
+			case "OR":
+				kind = tokOr
+			case "NOT":
+				kind = tokNot
+			}
+
+			tokens = append(tokens, tagToken{kind, word, i})
+			i += end
+		}
+	}
+
+	return append(tokens, tagToken{tokEnd, "", len(raw)}), nil
+}
+
+func (parser *tagParser) peek() tagToken {
+	return parser.tokens[parser.index]
+}
+
+func (parser *tagParser) next() tagToken {
+	token := parser.tokens[parser.index]
+	if token.kind != tokEnd {
+		parser.index++
+	}
+	return token
+}
+
+func (parser *tagParser) unexpected(token tagToken) error {
+	if token.kind == tokEnd {
+		return fmt.Errorf("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected '%v' at %v", token.text, token.pos)
+}
+
+func (parser *tagParser) parseOr() (*TagExpr, error) {
+	lhs, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []*TagExpr{lhs}
+	for parser.peek().kind == tokOr {
+		parser.next()
+
+		rhs, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, rhs)
+	}
+
+	if len(args) == 1 {
+		return lhs, nil
+	}
+	return &TagExpr{Op: TagOpOr, Args: args}, nil
+}
+
+func (parser *tagParser) parseAnd() (*TagExpr, error) {
+	lhs, err := parser.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []*TagExpr{lhs}
+	for {
+		switch parser.peek().kind {
+		case tokAnd:
+			parser.next()
+		case tokTag, tokNot, tokOpen:
+		default:
+			if len(args) == 1 {
+				return lhs, nil
+			}
+			return &TagExpr{Op: TagOpAnd, Args: args}, nil
+		}
+
+		rhs, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, rhs)
+	}
+}
+
+func (parser *tagParser) parseUnary() (*TagExpr, error) {
+	if parser.depth++; parser.depth > tagExprMaxDepth {
+		return nil, fmt.Errorf("expression nested more than %v levels", tagExprMaxDepth)
+	}
+	defer func() { parser.depth-- }()
+
+	switch token := parser.next(); token.kind {
+
+	case tokNot:
+		arg, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &TagExpr{Op: TagOpNot, Args: []*TagExpr{arg}}, nil
+
+	case tokOpen:
+		expr, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if token := parser.next(); token.kind != tokClose {
+			return nil, parser.unexpected(token)
+		}
+		return expr, nil
+
+	case tokTag:
+		if parser.terms++; parser.terms > tagExprMaxTerms {
+			return nil, fmt.Errorf("expression has more than %v tags", tagExprMaxTerms)
+		}
+		if ok, tag := (Query{}).parseTag(token.text); !ok || tag == "" {
+			return nil, fmt.Errorf("invalid tag '%v' at %v", token.text, token.pos)
+		}
+		return &TagExpr{Op: TagOpTag, Tag: token.text}, nil
+
+	default:
+		return nil, parser.unexpected(token)
+	}
+}
+
+func ParseTagExpr(raw string) (*TagExpr, error) {
+	tokens, err := tagLex(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &tagParser{tokens: tokens}
+	if parser.peek().kind == tokEnd {
+		return nil, nil
+	}
+
+	expr, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if token := parser.next(); token.kind != tokEnd {
+		return nil, parser.unexpected(token)
+	}
+
+	return expr, nil
+}
+
+// Compiles the expression into a parameterized sql condition over the records
+// table.
+func (expr *TagExpr) Sql() (string, []interface{}) {
+	switch expr.Op {
+
+	case TagOpTag:
+		return "records.id in (select record_id from tags where tag = ?)", []interface{}{expr.Tag}
+
+	case TagOpNot:
+		query, args := expr.Args[0].Sql()
+		return "not (" + query + ")", args
+
+	default:
+		sep := " and "
+		if expr.Op == TagOpOr {
+			sep = " or "
+		}
+
+		queries := []string{}
+		args := []interface{}{}
+		for _, arg := range expr.Args {
+			query, argArgs := arg.Sql()
+			queries = append(queries, query)
+			args = append(args, argArgs...)
+		}
+		return "(" + strings.Join(queries, sep) + ")", args
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTagExpr(t *testing.T) {
+	tag := func(tag string) *TagExpr { return &TagExpr{Op: TagOpTag, Tag: tag} }
+	and := func(args ...*TagExpr) *TagExpr { return &TagExpr{Op: TagOpAnd, Args: args} }
+	or := func(args ...*TagExpr) *TagExpr { return &TagExpr{Op: TagOpOr, Args: args} }
+	not := func(arg *TagExpr) *TagExpr { return &TagExpr{Op: TagOpNot, Args: []*TagExpr{arg}} }
+
+	tests := []struct {
+		raw  string
+		expr *TagExpr
+	}{
+		{"", nil},
+		{"  ", nil},
+		{"cat", tag("cat")},
+		{"cat,dog,bird", and(tag("cat"), tag("dog"), tag("bird"))},
+		{"cat dog", and(tag("cat"), tag("dog"))},
+		{"cat AND dog", and(tag("cat"), tag("dog"))},
+		{"cat & dog", and(tag("cat"), tag("dog"))},
+		{"cat OR dog", or(tag("cat"), tag("dog"))},
+		{"cat | dog | bird", or(tag("cat"), tag("dog"), tag("bird"))},
+		{"NOT cat", not(tag("cat"))},
+		{"!!cat", not(not(tag("cat")))},
+		{"cat dog | bird", or(and(tag("cat"), tag("dog")), tag("bird"))},
+		{"cat (dog | bird)", and(tag("cat"), or(tag("dog"), tag("bird")))},
+		{"@author #channel", and(tag("@author"), tag("#channel"))},
+		{`"big cat" | "OR"`, or(tag("big cat"), tag("OR"))},
+		{"cat !dog", and(tag("cat"), not(tag("dog")))},
+	}
+
+	for _, test := range tests {
+		expr, err := ParseTagExpr(test.raw)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.raw, err)
+		} else if !reflect.DeepEqual(expr, test.expr) {
+			t.Errorf("%q: got %+v, expected %+v", test.raw, expr, test.expr)
+		}
+	}
+}
+
+func TestParseTagExprErrors(t *testing.T) {
+	tests := []string{
+		"(",
+		"cat)",
+		"(cat",
+		"cat |",
+		"| cat",
+		"NOT",
+		`"cat`,
+		`""`,
+		strings.Repeat("(", tagExprMaxDepth+1) + "cat" + strings.Repeat(")", tagExprMaxDepth+1),
+		strings.Repeat("cat ", tagExprMaxTerms+1),
+		strings.Repeat("x", 51),
+	}
+
+	for _, raw := range tests {
+		if expr, err := ParseTagExpr(raw); err == nil {
+			t.Errorf("%q: expected an error, got %+v", raw, expr)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token bucket rate limiter applied per route group. Requests are first limited
+// by client IP such that credentials are only looked up for the clients within
+// their limits, and the authenticated clients are then also limited by their
+// API key or session. The client IP is taken from the X-Forwarded-For header
+// only when the request comes from one of the configured trusted proxies.
+
+const limitIdle = 10 * time.Minute
+
+// Throttled requests per route group. Only served on the admin bind as it's
+// of no business to the clients.
+var (
+	limitThrottledLock sync.Mutex
+	limitThrottled     = make(map[string]int64)
+)
+
+type limitBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type limiter struct {
+	lock    sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*limitBucket
+}
+
+var (
+	limiters       = make(map[string]*limiter)
+	trustedProxies = []*net.IPNet{}
+)
+
+func LimitInit() {
+	for group, config := range Config.Http.RateLimits {
+		if config.Rate <= 0 || config.Burst <= 0 {
+			Fatal("invalid rate limit for '%v': rate and burst must be positive", group)
+		}
+
+		limiters[group] = &limiter{
+			rate:    config.Rate,
+			burst:   float64(config.Burst),
+			buckets: make(map[string]*limitBucket),
+		}
+	}
+
+	for _, proxy := range Config.Http.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			Fatal("invalid trusted proxy '%v': %v", proxy, err)
+		}
+		trustedProxies = append(trustedProxies, ipnet)
+	}
+
+	go limitSweep()
+}
+
+// Returns the time to wait until a token is available or zero if a token was
+// taken.
+func (limiter *limiter) take(client string) time.Duration {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := time.Now()
+	bucket, ok := limiter.buckets[client]
+	if !ok {
+		bucket = &limitBucket{tokens: limiter.burst, last: now}
+		limiter.buckets[client] = bucket
+	}
+
+	elapsed := now.Sub(bucket.last).Seconds()
+	bucket.tokens = math.Min(limiter.burst, bucket.tokens+elapsed*limiter.rate)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0
+	}
+
+	wait := (1 - bucket.tokens) / limiter.rate
+	return time.Duration(wait * float64(time.Second))
+}
+
+// Idle buckets are full so they can be dropped without changing the outcome.
+func limitSweep() {
+	for range time.Tick(limitIdle) {
+		for _, limiter := range limiters {
+			limiter.lock.Lock()
+			for client, bucket := range limiter.buckets {
+				if time.Since(bucket.last) > limitIdle {
+					delete(limiter.buckets, client)
+				}
+			}
+			limiter.lock.Unlock()
+		}
+	}
+}
+
+func limitTrusted(ip net.IP) bool {
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func limitClientIp(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !limitTrusted(ip) {
+		return host
+	}
+
+	// Walk the forwarded chain from the closest hop and stop at the first
+	// address that isn't one of our proxies as anything before it could have
+	// been forged by the client.
+	hops := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		if !limitTrusted(hop) {
+			return hop.String()
+		}
+		host = hop.String()
+	}
+
+	return host
+}
+
+// Only valid credentials are used to identify a client otherwise rotating bogus
+// credentials would be enough to dodge the limits.
+func limitTake(limiter *limiter, req *http.Request) time.Duration {
+	if wait := limiter.take("ip:" + limitClientIp(req)); wait > 0 {
+		return wait
+	}
+
+	if principal := authenticate(req); principal != nil {
+		return limiter.take(principal.Actor)
+	}
+	return 0
+}
+
+func limit(group string, fn func(http.ResponseWriter, *http.Request) int) func(http.ResponseWriter, *http.Request) int {
+	return func(writer http.ResponseWriter, req *http.Request) int {
+		limiter, ok := limiters[group]
+		if !ok {
+			return fn(writer, req)
+		}
+
+		wait := limitTake(limiter, req)
+		if wait == 0 {
+			return fn(writer, req)
+		}
+
+		limitThrottledLock.Lock()
+		limitThrottled[group]++
+		limitThrottledLock.Unlock()
+
+		seconds := int64(math.Ceil(wait.Seconds()))
+		writer.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+		return respCode(http.StatusTooManyRequests, writer, req)
+	}
+}
+
+// GET /debug/throttled
+func limitStats(writer http.ResponseWriter, req *http.Request) int {
+	limitThrottledLock.Lock()
+	stats := make(map[string]int64, len(limitThrottled))
+	for group, count := range limitThrottled {
+		stats[group] = count
+	}
+	limitThrottledLock.Unlock()
+
+	return respJson(stats, writer, req)
+}
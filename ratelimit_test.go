@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiterTake(t *testing.T) {
+	limiter := &limiter{rate: 1, burst: 3, buckets: make(map[string]*limitBucket)}
+
+	for i := 0; i < 3; i++ {
+		if wait := limiter.take("a"); wait != 0 {
+			t.Fatalf("take %v: expected a token, got wait %v", i, wait)
+		}
+	}
+
+	if wait := limiter.take("a"); wait <= 0 || wait > time.Second {
+		t.Errorf("empty bucket: expected a wait of at most 1s, got %v", wait)
+	}
+
+	if wait := limiter.take("b"); wait != 0 {
+		t.Errorf("other client: expected a token, got wait %v", wait)
+	}
+
+	// Refills at the rate but never above the burst.
+	limiter.buckets["a"].last = time.Now().Add(-2 * time.Second)
+	for i := 0; i < 2; i++ {
+		if wait := limiter.take("a"); wait != 0 {
+			t.Fatalf("refilled take %v: expected a token, got wait %v", i, wait)
+		}
+	}
+	if wait := limiter.take("a"); wait == 0 {
+		t.Errorf("refilled bucket: expected to be empty")
+	}
+
+	limiter.buckets["a"].last = time.Now().Add(-time.Hour)
+	limiter.take("a")
+	if tokens := limiter.buckets["a"].tokens; tokens > 2 {
+		t.Errorf("idle bucket: expected at most burst - 1 tokens, got %v", tokens)
+	}
+}
+
+func TestLimitClientIp(t *testing.T) {
+	defer func(saved []*net.IPNet) { trustedProxies = saved }(trustedProxies)
+
+	trustedProxies = []*net.IPNet{}
+	for _, cidr := range []string{"10.0.0.0/8", "::1/128"} {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trustedProxies = append(trustedProxies, ipnet)
+	}
+
+	tests := []struct {
+		remote    string
+		forwarded string
+		client    string
+	}{
+		{"1.2.3.4:1234", "", "1.2.3.4"},
+		{"1.2.3.4:1234", "5.6.7.8", "1.2.3.4"},
+		{"1.2.3.4", "", "1.2.3.4"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "5.6.7.8", "5.6.7.8"},
+		{"10.0.0.1:1234", "6.6.6.6, 5.6.7.8", "5.6.7.8"},
+		{"10.0.0.1:1234", "5.6.7.8, 10.0.0.2", "5.6.7.8"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1:1234", "garbage, 10.0.0.2", "10.0.0.2"},
+		{"[::1]:1234", "2001:db8::1", "2001:db8::1"},
+	}
+
+	for _, test := range tests {
+		req := &http.Request{RemoteAddr: test.remote, Header: http.Header{}}
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+
+		if client := limitClientIp(req); client != test.client {
+			t.Errorf("%v [%v]: got %v, expected %v", test.remote, test.forwarded, client, test.client)
+		}
+	}
+}
+
+func TestLimitOrder(t *testing.T) {
+	defer func(saved []func(*http.Request) *Principal) { authenticators = saved }(authenticators)
+
+	lookups := 0
+	authenticators = []func(*http.Request) *Principal{
+		func(req *http.Request) *Principal {
+			lookups++
+			if authBearer(req) != "good" {
+				return nil
+			}
+			return &Principal{Actor: "key:good"}
+		},
+	}
+
+	limiters["test"] = &limiter{rate: 1, burst: 2, buckets: make(map[string]*limitBucket)}
+	defer delete(limiters, "test")
+
+	handler := limit("test", func(writer http.ResponseWriter, req *http.Request) int {
+		return respCode(http.StatusOK, writer, req)
+	})
+
+	serve := func(remote, key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remote
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		return handler(httptest.NewRecorder(), req)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		key     string
+		code    int
+		lookups int
+	}{
+		{"anonymous", "1.2.3.4:1", "", http.StatusOK, 1},
+		{"key", "1.2.3.4:1", "good", http.StatusOK, 1},
+		{"ip throttled", "1.2.3.4:1", "good", http.StatusTooManyRequests, 0},
+		{"bogus key throttled", "1.2.3.4:1", "bogus", http.StatusTooManyRequests, 0},
+		{"other ip", "5.6.7.8:1", "good", http.StatusOK, 1},
+		{"key throttled", "9.9.9.9:1", "good", http.StatusTooManyRequests, 1},
+	}
+
+	for _, test := range tests {
+		lookups = 0
+		if code := serve(test.remote, test.key); code != test.code {
+			t.Errorf("%v: got %v, expected %v", test.name, code, test.code)
+		}
+		if lookups != test.lookups {
+			t.Errorf("%v: got %v key lookups, expected %v", test.name, lookups, test.lookups)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Maps the Discord roles of guild members to archive permissions. The
+// permissions of the guild's @everyone role, whose id is the guild id, apply
+// to all members. Guilds without a role mapping only grant the read permission
+// to their members.
+//
+// Resolved permissions are cached to avoid hitting Discord on every request.
+// Membership is checked on every resolution such that the members who leave a
+// guild lose access to it once their cached permissions expire, even though
+// their session still lists the guild.
+
+const (
+	roleDefaultPerms = PermRead
+	roleDefaultTtl   = 5 * time.Minute
+)
+
+type roleEntry struct {
+	perms   Perm
+	expires time.Time
+}
+
+var (
+	roleLock  sync.Mutex
+	roleCache = make(map[string]roleEntry)
+	roleTtl   = roleDefaultTtl
+	rolePerms = make(map[string]map[string]Perm)
+)
+
+func RolesInit() {
+	for guild, roles := range Config.Auth.Roles {
+		rolePerms[guild] = make(map[string]Perm)
+		for role, names := range roles {
+			perms, err := ParsePerms(names)
+			if err != nil {
+				Fatal("invalid permissions for role '%v' of guild '%v': %v", role, guild, err)
+			}
+			rolePerms[guild][role] = perms
+		}
+	}
+
+	if Config.Auth.RoleTtl > 0 {
+		roleTtl = time.Duration(Config.Auth.RoleTtl) * time.Second
+	}
+}
+
+// Returns whether the roles of the guild are mapped to permissions.
+func RolesMapped(guild string) bool {
+	_, ok := rolePerms[guild]
+	return ok
+}
+
+func roleResolve(guild, user string) (Perm, error) {
+	member, err := DiscordGuildMember(guild, user)
+	if DiscordIsGone(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	roles, ok := rolePerms[guild]
+	if !ok {
+		return roleDefaultPerms, nil
+	}
+
+	if DiscordGuildOwner(guild) == user {
+		return PermAll, nil
+	}
+
+	perms := roles[guild]
+	for _, role := range member.Roles {
+		perms |= roles[role]
+	}
+	return perms, nil
+}
+
+// Returns the permissions of a user on a guild. Failures to reach Discord
+// aren't cached and result in no permissions.
+func RolePerms(guild, user string) Perm {
+	key := guild + ":" + user
+
+	roleLock.Lock()
+	entry, ok := roleCache[key]
+	roleLock.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.perms
+	}
+
+	perms, err := roleResolve(guild, user)
+	if err != nil {
+		Warning("unable to resolve roles of '%v' on '%v': %v", user, guild, err)
+		return 0
+	}
+
+	roleLock.Lock()
+	roleCache[key] = roleEntry{perms: perms, expires: time.Now().Add(roleTtl)}
+	roleLock.Unlock()
+
+	return perms
+}
@@ -0,0 +1,74 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRolePerms(t *testing.T) {
+	mux := testDiscord(t)
+
+	defer func(saved map[string]map[string]Perm) { rolePerms = saved }(rolePerms)
+	rolePerms = map[string]map[string]Perm{
+		"1": {"1": PermRead, "admins": PermAll},
+	}
+	roleCache = make(map[string]roleEntry)
+
+	// Members keyed by guild and user id; unknown members have left the guild.
+	members := map[string][]string{
+		"1/members/7": {"admins"},
+		"1/members/8": {},
+		"2/members/7": {},
+	}
+	mux.HandleFunc("/guilds/", func(writer http.ResponseWriter, req *http.Request) {
+		key := req.URL.Path[len("/guilds/"):]
+		roles, ok := members[key]
+		if !ok {
+			writer.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(writer, `{"code": 10007, "message": "Unknown Member"}`)
+			return
+		}
+		json.NewEncoder(writer).Encode(map[string]interface{}{"roles": roles})
+	})
+
+	tests := []struct {
+		name  string
+		guild string
+		user  string
+		perms Perm
+	}{
+		{"mapped role", "1", "7", PermAll},
+		{"everyone", "1", "8", PermRead},
+		{"unmapped guild", "2", "7", roleDefaultPerms},
+		{"not a member", "1", "9", 0},
+		{"not a member of unmapped guild", "2", "9", 0},
+	}
+
+	for _, test := range tests {
+		if perms := RolePerms(test.guild, test.user); perms != test.perms {
+			t.Errorf("%v: got %v, expected %v", test.name, perms, test.perms)
+		}
+	}
+
+	// Leaving the guild revokes access once the cached permissions expire.
+	delete(members, "2/members/7")
+	if perms := RolePerms("2", "7"); perms != roleDefaultPerms {
+		t.Errorf("cached: got %v, expected %v", perms, roleDefaultPerms)
+	}
+
+	roleLock.Lock()
+	entry := roleCache["2:7"]
+	entry.expires = time.Now().Add(-time.Second)
+	roleCache["2:7"] = entry
+	roleLock.Unlock()
+
+	if perms := RolePerms("2", "7"); perms != 0 {
+		t.Errorf("left: got %v, expected no permissions", perms)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Automatic tagging rules evaluated against every record as it's ingested. All
+// the conditions of a rule must match for its tags to be added and unset
+// conditions always match. Rules are configured per guild and can be
+// re-applied to the existing records with the -rules-apply flag, which leaves
+// alone the tags that were removed by hand.
+//
+// Records archived before the metadata columns were added have no author,
+// filename or dimensions and will therefore never match rules on these.
+
+type RuleConfig struct {
+	Tags []string `json:"tags"`
+
+	Caption  string   `json:"caption"`
+	Filename string   `json:"filename"`
+	Authors  []string `json:"authors"`
+	Channels []string `json:"channels"`
+
+	// Hours is a [from, to) range of hours of the day which wraps around
+	// midnight if from > to. Times are evaluated in Timezone, UTC by default.
+	Hours    []int    `json:"hours"`
+	Weekdays []string `json:"weekdays"`
+	Timezone string   `json:"timezone"`
+
+	MinWidth    int    `json:"min_width"`
+	MaxWidth    int    `json:"max_width"`
+	MinHeight   int    `json:"min_height"`
+	MaxHeight   int    `json:"max_height"`
+	MinSize     int    `json:"min_size"`
+	MaxSize     int    `json:"max_size"`
+	Orientation string `json:"orientation"`
+}
+
+type rule struct {
+	tags []string
+
+	caption  *regexp.Regexp
+	filename *regexp.Regexp
+	authors  map[string]bool
+	channels map[string]bool
+
+	hours    []int
+	weekdays map[time.Weekday]bool
+	location *time.Location
+
+	minWidth, maxWidth   int
+	minHeight, maxHeight int
+	minSize, maxSize     int
+	orientation          string
+}
+
+const rulesBatch = 500
+
+var rules = make(map[string][]*rule)
+
+func RulesInit() {
+	for guild, configs := range Config.Rules {
+		for i, config := range configs {
+			rule, err := ruleCompile(config)
+			if err != nil {
+				Fatal("invalid rule %v of guild '%v': %v", i, guild, err)
+			}
+			rules[guild] = append(rules[guild], rule)
+		}
+	}
+}
+
+func ruleSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+
+	set := make(map[string]bool)
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+func ruleCompile(config RuleConfig) (*rule, error) {
+	var err error
+	rule := &rule{
+		authors:     ruleSet(config.Authors),
+		channels:    ruleSet(config.Channels),
+		minWidth:    config.MinWidth,
+		maxWidth:    config.MaxWidth,
+		minHeight:   config.MinHeight,
+		maxHeight:   config.MaxHeight,
+		minSize:     config.MinSize,
+		maxSize:     config.MaxSize,
+		orientation: config.Orientation,
+		location:    time.UTC,
+	}
+
+	if len(config.Tags) == 0 {
+		return nil, fmt.Errorf("no tags")
+	}
+	for _, raw := range config.Tags {
+		ok, tag := (Query{}).parseTag(raw)
+		if !ok || tag == "" {
+			return nil, fmt.Errorf("invalid tag '%v'", raw)
+		}
+		rule.tags = append(rule.tags, tag)
+	}
+
+	if config.Caption != "" {
+		if rule.caption, err = regexp.Compile(config.Caption); err != nil {
+			return nil, fmt.Errorf("invalid caption regex: %v", err)
+		}
+	}
+
+	if config.Filename != "" {
+		if rule.filename, err = regexp.Compile(config.Filename); err != nil {
+			return nil, fmt.Errorf("invalid filename regex: %v", err)
+		}
+	}
+
+	if config.Hours != nil {
+		if len(config.Hours) != 2 ||
+			config.Hours[0] < 0 || config.Hours[0] > 23 ||
+			config.Hours[1] < 0 || config.Hours[1] > 24 {
+			return nil, fmt.Errorf("hours must be a [from, to) range within [0, 24]")
+		}
+		rule.hours = config.Hours
+	}
+
+	if len(config.Weekdays) > 0 {
+		rule.weekdays = make(map[time.Weekday]bool)
+		for _, name := range config.Weekdays {
+			day, ok := ruleWeekday(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown weekday '%v'", name)
+			}
+			rule.weekdays[day] = true
+		}
+	}
+
+	if config.Timezone != "" {
+		if rule.location, err = time.LoadLocation(config.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone: %v", err)
+		}
+	}
+
+	switch config.Orientation {
+	case "", "landscape", "portrait", "square":
+	default:
+		return nil, fmt.Errorf("unknown orientation '%v'", config.Orientation)
+	}
+
+	return rule, nil
+}
+
+func ruleWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(name)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		full := strings.ToLower(day.String())
+		if name == full || name == full[:3] {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+func ruleRange(value, min, max int) bool {
+	return (min == 0 || value >= min) && (max == 0 || value <= max)
+}
+
+func (rule *rule) match(rec *Record) bool {
+	if rule.caption != nil && !rule.caption.MatchString(rec.Caption) {
+		return false
+	}
+	if rule.filename != nil && !rule.filename.MatchString(path.Base(rec.Filename)) {
+		return false
+	}
+	if rule.authors != nil && !rule.authors[rec.AuthorId] {
+		return false
+	}
+	if rule.channels != nil && !rule.channels[rec.ChannelId] {
+		return false
+	}
+
+	ts := rec.Time.In(rule.location)
+	if rule.hours != nil {
+		hour, from, to := ts.Hour(), rule.hours[0], rule.hours[1]
+		if from <= to && (hour < from || hour >= to) {
+			return false
+		}
+		if from > to && hour < from && hour >= to {
+			return false
+		}
+	}
+	if rule.weekdays != nil && !rule.weekdays[ts.Weekday()] {
+		return false
+	}
+
+	if !ruleRange(rec.Width, rule.minWidth, rule.maxWidth) ||
+		!ruleRange(rec.Height, rule.minHeight, rule.maxHeight) ||
+		!ruleRange(rec.Size, rule.minSize, rule.maxSize) {
+		return false
+	}
+
+	switch rule.orientation {
+	case "landscape":
+		return rec.Width > rec.Height
+	case "portrait":
+		return rec.Width < rec.Height
+	case "square":
+		return rec.Width != 0 && rec.Width == rec.Height
+	}
+
+	return true
+}
+
+// Returns the tags of all the rules of the record's guild that match the
+// record, excluding the tags the record already has.
+func RulesMatch(rec *Record) []string {
+	seen := make(map[string]bool)
+	for _, tag := range rec.Tags {
+		seen[tag] = true
+	}
+
+	tags := []string{}
+	for _, rule := range rules[rec.GuildId] {
+		if !rule.match(rec) {
+			continue
+		}
+		for _, tag := range rule.tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+func RulesCommand() bool {
+	if !*rulesApply {
+		return false
+	}
+
+	RulesInit()
+
+	for guild := range rules {
+		count := 0
+		var after int64 = 0
+
+		for {
+			records := DatabaseRecordsAfter(guild, after, rulesBatch)
+			if len(records) == 0 {
+				break
+			}
+
+			for _, rec := range records {
+				after = rec.Id
+				tags := RulesMatch(rec)
+				if len(tags) > 0 && DatabaseTagsSetAuto(ActorRules, rec.Id, tags) != 0 {
+					count++
+				}
+			}
+		}
+
+		Info("rules matched %v records of guild %v", count, guild)
+	}
+
+	return true
+}
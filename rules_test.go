@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRuleMatch(t *testing.T) {
+	// Monday 14:30 UTC.
+	rec := &Record{
+		ChannelId: "10",
+		AuthorId:  "20",
+		Time:      time.Date(2020, 6, 15, 14, 30, 0, 0, time.UTC),
+		Caption:   "look at my cat",
+		Filename:  "IMG_0042.png",
+		Width:     1920,
+		Height:    1080,
+		Size:      2048,
+	}
+
+	tests := []struct {
+		name   string
+		config RuleConfig
+		match  bool
+	}{
+		{"empty", RuleConfig{}, true},
+		{"caption", RuleConfig{Caption: `\bcat\b`}, true},
+		{"caption miss", RuleConfig{Caption: `\bdog\b`}, false},
+		{"filename", RuleConfig{Filename: `^IMG_\d+\.png$`}, true},
+		{"filename miss", RuleConfig{Filename: `\.gif$`}, false},
+		{"author", RuleConfig{Authors: []string{"1", "20"}}, true},
+		{"author miss", RuleConfig{Authors: []string{"1"}}, false},
+		{"channel", RuleConfig{Channels: []string{"10"}}, true},
+		{"channel miss", RuleConfig{Channels: []string{"11"}}, false},
+		{"hours", RuleConfig{Hours: []int{14, 15}}, true},
+		{"hours end excluded", RuleConfig{Hours: []int{10, 14}}, false},
+		{"hours wrap", RuleConfig{Hours: []int{22, 15}}, true},
+		{"hours wrap miss", RuleConfig{Hours: []int{22, 6}}, false},
+		{"weekday", RuleConfig{Weekdays: []string{"mon", "Friday"}}, true},
+		{"weekday miss", RuleConfig{Weekdays: []string{"sunday"}}, false},
+		{"width", RuleConfig{MinWidth: 1920, MaxWidth: 1920}, true},
+		{"width miss", RuleConfig{MinWidth: 2000}, false},
+		{"height miss", RuleConfig{MaxHeight: 720}, false},
+		{"size", RuleConfig{MinSize: 1024, MaxSize: 4096}, true},
+		{"size miss", RuleConfig{MaxSize: 1024}, false},
+		{"landscape", RuleConfig{Orientation: "landscape"}, true},
+		{"portrait", RuleConfig{Orientation: "portrait"}, false},
+		{"square", RuleConfig{Orientation: "square"}, false},
+		{"all", RuleConfig{Caption: "cat", Channels: []string{"10"}, Hours: []int{9, 17}}, true},
+		{"all but one", RuleConfig{Caption: "cat", Channels: []string{"10"}, Hours: []int{9, 12}}, false},
+	}
+
+	for _, test := range tests {
+		test.config.Tags = []string{"tag"}
+		rule, err := ruleCompile(test.config)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if match := rule.match(rec); match != test.match {
+			t.Errorf("%v: got %v, expected %v", test.name, match, test.match)
+		}
+	}
+}
+
+func TestRuleMatchTimezone(t *testing.T) {
+	if _, err := time.LoadLocation("America/Toronto"); err != nil {
+		t.Skipf("timezone database unavailable: %v", err)
+	}
+
+	// Monday 02:00 UTC is still Sunday evening in Toronto.
+	rec := &Record{Time: time.Date(2020, 6, 15, 2, 0, 0, 0, time.UTC)}
+	rule, err := ruleCompile(RuleConfig{
+		Tags:     []string{"tag"},
+		Timezone: "America/Toronto",
+		Weekdays: []string{"sun"},
+		Hours:    []int{20, 24},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !rule.match(rec) {
+		t.Errorf("expected the rule to match in its timezone")
+	}
+}
+
+func TestRuleCompileErrors(t *testing.T) {
+	tests := []RuleConfig{
+		{},
+		{Tags: []string{""}},
+		{Tags: []string{"tag"}, Caption: "("},
+		{Tags: []string{"tag"}, Filename: "["},
+		{Tags: []string{"tag"}, Hours: []int{1}},
+		{Tags: []string{"tag"}, Hours: []int{24, 1}},
+		{Tags: []string{"tag"}, Weekdays: []string{"someday"}},
+		{Tags: []string{"tag"}, Timezone: "Nowhere/Special"},
+		{Tags: []string{"tag"}, Orientation: "diagonal"},
+	}
+
+	for _, config := range tests {
+		if _, err := ruleCompile(config); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// All the REST scraping goes through a bounded number of workers which process
+// one page of messages at a time such that no channel can hog the workers.
+// Forward tasks, which keep the archive up to date, are always picked before
+// the backfills and tasks whose rate limit bucket is exhausted are delayed
+// instead of holding a worker while discordgo sleeps.
+//
+// Every sub has a forward task which polls its channel as a safety net for
+// the gateway and a backfill task until its history is archived. Unfurl tasks
+// come and go with the messages whose embeds must be fetched again.
+
+// Tasks are picked in the order of their kind.
+const (
+	taskForward = iota
+	taskUnfurl
+	taskBackfill
+)
+
+const (
+	schedWorkersDefault = 4
+	schedIdle           = time.Minute
+)
+
+type task struct {
+	sub     *Sub
+	kind    int
+	at      time.Time
+	attempt int
+	running bool
+
+	// Set when the task is scheduled again while it's running.
+	rerun bool
+}
+
+var (
+	schedLock  sync.Mutex
+	schedTasks = []*task{}
+	schedWake  = make(chan struct{}, 1)
+)
+
+func SchedStart() {
+	workers := schedWorkersDefault
+	if Config.Discord.Workers > 0 {
+		workers = Config.Discord.Workers
+	}
+
+	slots := make(chan struct{}, workers)
+	go func() {
+		for {
+			slots <- struct{}{}
+
+			task := schedNext()
+			go func() {
+				schedRun(task)
+				<-slots
+			}()
+		}
+	}()
+}
+
+func schedSignal() {
+	select {
+	case schedWake <- struct{}{}:
+	default:
+	}
+}
+
+// Schedules a task for the sub unless one of the same kind already exists in
+// which case the existing task is moved up if needed.
+func schedAdd(sub *Sub, kind int, at time.Time) {
+	schedLock.Lock()
+	defer schedLock.Unlock()
+
+	for _, task := range schedTasks {
+		if task.sub == sub && task.kind == kind {
+			if task.running {
+				task.rerun = true
+			} else if at.Before(task.at) {
+				task.at = at
+			}
+			schedSignal()
+			return
+		}
+	}
+
+	schedTasks = append(schedTasks, &task{sub: sub, kind: kind, at: at})
+	schedSignal()
+}
+
+// Blocks until a task is due. Tasks of stopped subs are dropped along the way.
+func schedNext() *task {
+	for {
+		next, wait := schedPick()
+		if next != nil {
+			return next
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-schedWake:
+		}
+	}
+}
+
+func schedPick() (*task, time.Duration) {
+	schedLock.Lock()
+	defer schedLock.Unlock()
+
+	now := time.Now()
+	wait := schedIdle
+
+	var best *task
+	tasks := schedTasks[:0]
+	for _, task := range schedTasks {
+		if task.sub.stopped() && !task.running {
+			continue
+		}
+		tasks = append(tasks, task)
+
+		if task.running {
+			continue
+		}
+		if task.at.After(now) {
+			if delay := task.at.Sub(now); delay < wait {
+				wait = delay
+			}
+			continue
+		}
+
+		if best == nil || task.kind < best.kind ||
+			(task.kind == best.kind && task.at.Before(best.at)) {
+			best = task
+		}
+	}
+	schedTasks = tasks
+
+	if best != nil {
+		best.running = true
+	}
+	return best, wait
+}
+
+func schedReschedule(task *task, at time.Time) {
+	schedLock.Lock()
+	defer schedLock.Unlock()
+
+	task.running = false
+	task.at = at
+	if task.rerun && at.After(time.Now()) {
+		task.at = time.Now()
+	}
+	task.rerun = false
+	schedSignal()
+}
+
+// Tasks scheduled again while they were running are kept.
+func schedDrop(task *task) {
+	schedLock.Lock()
+	defer schedLock.Unlock()
+
+	if task.rerun {
+		task.running = false
+		task.rerun = false
+		task.at = time.Now()
+		schedSignal()
+		return
+	}
+
+	for i, other := range schedTasks {
+		if other == task {
+			schedTasks = append(schedTasks[:i], schedTasks[i+1:]...)
+			break
+		}
+	}
+}
+
+func schedRun(task *task) {
+	sub := task.sub
+	if sub.stopped() {
+		schedDrop(task)
+		return
+	}
+
+	if wait := DiscordRateWait(sub.Channel); wait > 0 {
+		schedReschedule(task, time.Now().Add(wait))
+		return
+	}
+	if wait := superviseAuthWait(); wait > 0 {
+		schedReschedule(task, time.Now().Add(wait))
+		return
+	}
+
+	var name string
+	var more bool
+	var err error
+	switch task.kind {
+	case taskForward:
+		name = "forward"
+		more, err = scrapeForwardPage(sub)
+	case taskUnfurl:
+		name = "unfurl"
+		more, err = scrapeUnfurlPage(sub)
+	default:
+		name = "backfill"
+		more, err = scrapeBackwardsPage(sub)
+	}
+
+	if err != nil {
+		if delay, retry := supervise(sub, name, task.attempt, err); retry {
+			task.attempt++
+			schedReschedule(task, time.Now().Add(delay))
+		} else {
+			schedDrop(task)
+		}
+		return
+	}
+
+	if task.attempt > 0 {
+		superviseRecovered(sub, name)
+		task.attempt = 0
+	}
+
+	switch {
+	case more:
+		schedReschedule(task, time.Now())
+	case task.kind == taskForward:
+		schedReschedule(task, time.Now().Add(scrapeForwardDone(sub)))
+	default:
+		schedDrop(task)
+	}
+}
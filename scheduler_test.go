@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedPick(t *testing.T) {
+	defer func(saved []*task) { schedTasks = saved }(schedTasks)
+	schedTasks = []*task{}
+
+	now := time.Now()
+	busy := &Sub{Channel: "busy", stop: make(chan struct{})}
+	quiet := &Sub{Channel: "quiet", stop: make(chan struct{})}
+	stopped := &Sub{Channel: "stopped", stop: make(chan struct{})}
+	close(stopped.stop)
+
+	// Added out of order: the kind wins over the due time and the earliest
+	// task wins within a kind.
+	schedAdd(busy, taskBackfill, now.Add(-3*time.Second))
+	schedAdd(quiet, taskBackfill, now.Add(-4*time.Second))
+	schedAdd(busy, taskUnfurl, now.Add(-time.Second))
+	schedAdd(quiet, taskForward, now.Add(-time.Second))
+	schedAdd(busy, taskForward, now.Add(-2*time.Second))
+	schedAdd(stopped, taskForward, now.Add(-time.Hour))
+	schedAdd(quiet, taskUnfurl, now.Add(time.Minute))
+
+	// Scheduling an existing task again only moves it up.
+	schedAdd(busy, taskForward, now)
+
+	expected := []struct {
+		sub  *Sub
+		kind int
+	}{
+		{busy, taskForward},
+		{quiet, taskForward},
+		{busy, taskUnfurl},
+		{quiet, taskBackfill},
+		{busy, taskBackfill},
+	}
+
+	for i, exp := range expected {
+		task, _ := schedPick()
+		if task == nil {
+			t.Fatalf("pick %v: expected a task", i)
+		}
+		if task.sub != exp.sub || task.kind != exp.kind {
+			t.Errorf("pick %v: got %v/%v, expected %v/%v",
+				i, task.sub.Channel, task.kind, exp.sub.Channel, exp.kind)
+		}
+		if !task.running {
+			t.Errorf("pick %v: expected the task to be marked as running", i)
+		}
+	}
+
+	// Only the future unfurl is left, running tasks are never picked twice.
+	task, wait := schedPick()
+	if task != nil {
+		t.Errorf("future: got %v/%v, expected nothing", task.sub.Channel, task.kind)
+	}
+	if wait <= 0 || wait > time.Minute {
+		t.Errorf("future: got wait %v, expected at most a minute", wait)
+	}
+
+	for _, task := range schedTasks {
+		if task.sub == stopped {
+			t.Errorf("stopped: expected the task of the stopped sub to be dropped")
+		}
+	}
+	if len(schedTasks) != 6 {
+		t.Errorf("expected 6 tasks left, got %v", len(schedTasks))
+	}
+}
+
+func TestSchedRerun(t *testing.T) {
+	defer func(saved []*task) { schedTasks = saved }(schedTasks)
+	schedTasks = []*task{}
+
+	sub := &Sub{Channel: "sub", stop: make(chan struct{})}
+	schedAdd(sub, taskUnfurl, time.Now())
+
+	task, _ := schedPick()
+	if task == nil {
+		t.Fatal("expected a task")
+	}
+
+	// Scheduled again while running, the task survives being dropped.
+	schedAdd(sub, taskUnfurl, time.Now())
+	schedDrop(task)
+	if next, _ := schedPick(); next != task {
+		t.Errorf("rerun: expected the task to be picked again")
+	}
+
+	schedDrop(task)
+	if len(schedTasks) != 0 {
+		t.Errorf("drop: expected no tasks, got %v", len(schedTasks))
+	}
+}
@@ -1,122 +1,690 @@
 package main
 
 import (
-	"strings"
+	"regexp"
+	"sync"
 	"time"
 )
 
-const sleep = 1 * time.Second
+// Messages are ingested live through the gateway while the REST API is only
+// used to fill the gaps left by disconnects and to backfill the history.
+type Sub struct {
+	Guild   string
+	Channel string
+
+	lock     sync.Mutex
+	latest   string
+	earliest string
+	live     string
+	catching bool
+
+	// Messages seen since the last poll which drive the poll interval.
+	seen     int
+	interval time.Duration
+
+	// Messages whose embeds were unfurled and must be fetched again.
+	unfurled []string
+
+	stop chan struct{}
+}
+
+// The subs table is the source of truth for the channels to archive. Subs are
+// started and stopped to match the enabled subs whenever they change.
+var (
+	subsLock sync.RWMutex
+	subs     = make(map[string]*Sub)
+)
+
+const (
+	scrapeRefreshDefault = time.Hour
+	scrapeSyncInterval   = time.Minute
+
+	// Bounds of the interval at which channels are polled for the messages
+	// the gateway might have missed.
+	scrapePollMin = time.Minute
+	scrapePollMax = time.Hour
+)
+
+func subGet(channel string) (*Sub, bool) {
+	subsLock.RLock()
+	defer subsLock.RUnlock()
+
+	sub, ok := subs[channel]
+	return sub, ok
+}
+
+func (sub *Sub) stopped() bool {
+	select {
+	case <-sub.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// The guilds of the running subs.
+func scrapeGuilds() map[string]bool {
+	subsLock.RLock()
+	defer subsLock.RUnlock()
+
+	guilds := make(map[string]bool)
+	for _, sub := range subs {
+		guilds[sub.Guild] = true
+	}
+	return guilds
+}
 
 func ScrapperStart() {
+	// Subs from the config are imported once and can then be disabled.
 	for guild, channels := range Config.Discord.Subs {
-		for _, channelId := range channels {
-			earliest, latest := DatabaseSub(channelId)
-			Info("scrape guild:%v chan:%v fwd:%v back:%v", guild, channelId, latest, earliest)
+		for _, channel := range channels {
+			DatabaseSubSeed(guild, channel)
+		}
+	}
+
+	ScrapperSync()
+
+	DiscordOnMessage(scrapeLive)
+	DiscordOnMessageUpdate(scrapeUpdate)
+	DiscordOnMessageDelete(scrapeDelete)
+	DiscordOnMemberUpdate(scrapeMember)
+	DiscordOnGuildUpdate(scrapeGuild)
+	DiscordOnChannelUpdate(scrapeChannel)
+	DiscordOnReaction(scrapeReaction)
+	DiscordOnReactionClear(scrapeReactionClear)
+	DiscordOnReady(func() {
+		subsLock.RLock()
+		defer subsLock.RUnlock()
+
+		// Live messages can arrive before a worker picks up the catch up so
+		// the checkpoint must be held back right away.
+		for _, sub := range subs {
+			sub.lock.Lock()
+			sub.catching = true
+			sub.lock.Unlock()
 
-			channelName := DiscordChannelName(channelId)
-			go scrapeForward(guild, channelId, channelName, latest)
-			go scrapeBackwards(guild, channelId, channelName, earliest)
+			schedAdd(sub, taskForward, time.Now())
 		}
+	})
+
+	SchedStart()
+	DiscordOpen()
+
+	go func() {
+		for range time.Tick(scrapeSyncInterval) {
+			ScrapperSync()
+		}
+	}()
+
+	go func() {
+		interval := scrapeRefreshDefault
+		if Config.Discord.Refresh > 0 {
+			interval = time.Duration(Config.Discord.Refresh) * time.Second
+		}
+
+		for range time.Tick(interval) {
+			for guild := range scrapeGuilds() {
+				if err := scrapeRefresh(guild); err != nil {
+					Warning("unable to refresh metadata of guild '%v': %v", guild, err)
+				}
+			}
+		}
+	}()
+}
+
+// Starts the workers of the enabled subs that aren't running and stops the
+// workers of the subs that were disabled or removed.
+func ScrapperSync() {
+	enabled := make(map[string]bool)
+	pending := []*Subscription{}
+	for _, entry := range DatabaseSubs() {
+		if !entry.Enabled || entry.State == SubPaused {
+			continue
+		}
+		enabled[entry.Channel] = true
+
+		if _, ok := subGet(entry.Channel); ok {
+			continue
+		}
+
+		// Channel names must be known before any message is archived.
+		if DatabaseChannelName(entry.Channel) == "" {
+			if err := scrapeRefresh(entry.Guild); err != nil {
+				Warning("unable to fetch metadata of guild '%v': %v", entry.Guild, err)
+				continue
+			}
+		}
+
+		pending = append(pending, entry)
+	}
+
+	subsLock.Lock()
+	defer subsLock.Unlock()
+
+	for _, entry := range pending {
+		if _, ok := subs[entry.Channel]; !ok {
+			scrapeStart(entry)
+		}
+	}
+
+	for channel, sub := range subs {
+		if !enabled[channel] {
+			scrapeStop(sub)
+		}
+	}
+}
+
+// Must be called with the subs lock held.
+func scrapeStop(sub *Sub) {
+	if sub.stopped() {
+		return
+	}
+
+	close(sub.stop)
+	delete(subs, sub.Channel)
+	Info("unscrape guild:%v chan:%v", sub.Guild, sub.Channel)
+}
+
+// Must be called with the subs lock held.
+func scrapeStart(entry *Subscription) {
+	Info("scrape guild:%v chan:%v fwd:%v back:%v",
+		entry.Guild, entry.Channel, entry.Latest, entry.Earliest)
+
+	sub := &Sub{
+		Guild:    entry.Guild,
+		Channel:  entry.Channel,
+		latest:   entry.Latest,
+		earliest: entry.Earliest,
+		catching: true,
+		interval: scrapePollMin,
+		stop:     make(chan struct{}),
+	}
+	subs[entry.Channel] = sub
+
+	// Errors left over from a previous run get another chance.
+	if entry.State == SubErrored {
+		DatabaseSubState(entry.Channel, SubHealthy, "")
+	}
+
+	schedAdd(sub, taskForward, time.Now())
+	if !entry.Options.SkipBackfill {
+		schedAdd(sub, taskBackfill, time.Now())
+	}
+}
+
+// Enables or disables the archiving of a channel.
+func ScrapperSubscribe(guild, channel string, enabled bool, options SubOptions) {
+	DatabaseSubSet(guild, channel, enabled, options)
+	ScrapperSync()
+}
+
+// Resumes the backfill of a running sub from its earliest message. Returns
+// false if the sub isn't running.
+func ScrapperBackfill(channel string) bool {
+	sub, ok := subGet(channel)
+	if !ok {
+		return false
+	}
+
+	schedAdd(sub, taskBackfill, time.Now())
+	return true
+}
+
+func ScrapperRunning(channel string) bool {
+	_, ok := subGet(channel)
+	return ok
+}
+
+// The gateway notifies us of most changes to guilds and channels but anything
+// missed while disconnected is only caught by the periodic refresh.
+func scrapeRefresh(guild string) error {
+	info, err := DiscordGuild(guild)
+	if err != nil {
+		return err
+	}
+
+	channels, err := DiscordGuildChannels(guild)
+	if err != nil {
+		return err
+	}
+
+	DatabaseGuildUpdate(info)
+	for _, channel := range channels {
+		DatabaseChannelUpdate(ActorScraper, channel)
 	}
+	return nil
 }
 
-func validAttachment(attach *Attachment) bool {
-	file := attach.Filename
-	return strings.HasSuffix(file, ".jpg") ||
-		strings.HasSuffix(file, ".jpeg") ||
-		strings.HasSuffix(file, ".png") ||
-		strings.HasSuffix(file, ".gif")
+func scrapeGuild(guild *Guild, channels []*Channel) {
+	if !scrapeGuilds()[guild.Id] {
+		return
+	}
+
+	DatabaseGuildUpdate(guild)
+	for _, channel := range channels {
+		DatabaseChannelUpdate(ActorScraper, channel)
+	}
+}
+
+func scrapeChannel(channel *Channel) {
+	if !scrapeGuilds()[channel.GuildId] {
+		return
+	}
+
+	DatabaseChannelUpdate(ActorScraper, channel)
+}
+
+// Must be called with the sub lock held.
+func (sub *Sub) advance(pos string) {
+	if !DiscordIdLess(sub.latest, pos) {
+		return
+	}
+	DatabaseSubUpdateLatest(sub.Channel, pos)
+	sub.latest = pos
 }
 
-func message(guild, channelName string, msg *Message) (bool, error) {
-	kept := false
+// Hashtags must start a word which excludes the raw <#id> channel mentions.
+var hashtagRegex = regexp.MustCompile(`(?:^|[^\w&<])#([\p{L}\p{N}_-]+)`)
+
+// Returns the name under which an author is tagged. Messages ingested one at a
+// time use DatabaseAuthorSeen while pages defer the writes to the page's
+// transaction.
+type authorNames func(guild string, author *Author) string
+
+// Extracts the readable caption of a message along with the tags for its
+// hashtags and mentioned users.
+func caption(guild string, msg *Message, names authorNames) (string, []string) {
+	tags := []string{}
+	seen := make(map[string]bool)
+	add := func(tag string) {
+		if ok, tag := (Query{}).parseTag(tag); ok && tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	for _, match := range hashtagRegex.FindAllStringSubmatch(msg.Content, -1) {
+		add(match[1])
+	}
+	for _, author := range DiscordMentionAuthors(msg) {
+		add("@" + names(guild, author))
+	}
+
+	return DiscordContent(guild, msg, func(author *Author) string { return names(guild, author) }), tags
+}
+
+// Builds the records of the images attached to a message.
+func message(guild string, msg *Message, names authorNames) ([]*Record, error) {
+	records := []*Record{}
 	// Debug("filter guild:%v chan:%v msg:%v", guild, msg.ChannelID, msg.ID)
 
 	ts, err := DiscordTimestamp(msg.ID)
 	if err != nil {
-		return kept, err
+		return nil, err
 	}
 
-	for _, attach := range msg.Attachments {
-		if !validAttachment((*Attachment)(attach)) {
-			continue
-		}
+	if msg.GuildID != "" {
+		guild = msg.GuildID
+	}
+
+	imgs := images(guild, msg)
+	if len(imgs) == 0 {
+		return records, nil
+	}
+	text, tags := caption(guild, msg, names)
+	author := DiscordMessageAuthor(msg)
+	tags = append([]string{
+		"@" + names(guild, author),
+		"#" + DatabaseChannelName(msg.ChannelID),
+	}, tags...)
 
-		if msg.GuildID != "" {
-			guild = msg.GuildID
+	reactions := make(map[string]int)
+	for _, react := range msg.Reactions {
+		key, tag := reaction(guild, (*Emoji)(react.Emoji))
+		reactions[key] = react.Count
+		if tag != "" {
+			tags = append(tags, tag)
 		}
+	}
 
+	for _, img := range imgs {
 		rec := &Record{
 			GuildId:   guild,
 			ChannelId: msg.ChannelID,
 			MessageId: msg.ID,
-			ImageId:   attach.ID,
+			ImageId:   img.id,
+			Source:    img.source,
 			Time:      ts,
-			Path:      attach.URL,
-			Caption:   msg.Content,
-			Tags:      []string{"@" + msg.Author.Username, "#" + channelName},
+			Path:      img.url,
+			Caption:   text,
+			AuthorId:  author.Id,
+			Filename:  img.filename,
+			Width:     img.width,
+			Height:    img.height,
+			Size:      img.size,
+			Tags:      append([]string{}, tags...),
+			Reactions: reactions,
 		}
+		if img.provider != "" {
+			rec.Tags = append(rec.Tags, imageTag(img.provider))
+		}
+		rec.Tags = append(rec.Tags, RulesMatch(rec)...)
 
-		id := DatabaseRecordInsert(rec)
-		kept = true
-
-		Info("put %v -> guild:%v chan:%v msg:%v img:%v",
-			id, rec.GuildId, rec.ChannelId, rec.MessageId, rec.ImageId)
+		records = append(records, rec)
 	}
 
-	return kept, nil
+	return records, nil
 }
 
-func scrapeForward(guild, channelId, channelName, from string) {
-	it, err := DiscordMessageForwardIt(channelId, from)
-	if err != nil {
-		Fatal("unable to create iterator for '%v': %v", channelId, it)
+func messageLog(id int64, rec *Record) {
+	Info("put %v -> guild:%v chan:%v msg:%v img:%v",
+		id, rec.GuildId, rec.ChannelId, rec.MessageId, rec.ImageId)
+}
+
+// Archives a page of messages and moves the checkpoint of the sub to the last
+// message of the page in a single transaction. Returns the number of messages
+// that were kept.
+func messagePage(sub *Sub, msgs []*Message, checkpoint string) int {
+	ids := []string{}
+	for _, msg := range msgs {
+		ids = append(ids, DiscordMessageAuthor(msg).Id)
+		for _, author := range DiscordMentionAuthors(msg) {
+			ids = append(ids, author.Id)
+		}
 	}
+	known := DatabaseAuthorNames(sub.Guild, ids)
 
-	for true {
-		msg, err := it.DiscordItNext()
-		if err != nil {
-			Fatal("unable to read message for '%v': %v", channelId, err)
+	// Unknown authors are named after the first message they're seen in
+	// until they're recorded with the page. Their tag must also be told apart
+	// from the other new authors of the page.
+	authors := []*Author{}
+	names := func(guild string, author *Author) string {
+		if name, ok := known[author.Id]; ok {
+			return name
+		}
+
+		author.Tag = DatabaseAuthorTag(guild, author)
+		for _, other := range authors {
+			if other.Tag == author.Tag {
+				author.Tag = authorTag(author, true)
+			}
 		}
-		if msg == nil {
-			time.Sleep(sleep)
+
+		known[author.Id] = author.Tag
+		authors = append(authors, author)
+		return author.Tag
+	}
+
+	count := 0
+	records := []*Record{}
+	for _, msg := range msgs {
+		recs, err := message(sub.Guild, msg, names)
+		if err != nil {
+			Warning("failed to parse '%v': %v", msg.ID, err)
 			continue
 		}
+		if len(recs) > 0 {
+			count++
+		}
+		records = append(records, recs...)
+	}
+
+	inserted := DatabaseRecordsInsertPage(
+		sub.Guild, authors, records, sub.Channel, checkpoint, msgs[len(msgs)-1].ID)
+	for i, rec := range records {
+		messageLog(inserted[i], rec)
+	}
+	return count
+}
+
+func scrapeLive(msg *Message) {
+	sub, ok := subGet(msg.ChannelID)
+	if !ok {
+		return
+	}
+
+	// Only the gateway carries the nickname of the author and is recent enough
+	// to override the known names.
+	if msg.Member != nil {
+		DatabaseAuthorUpdate(ActorScraper, sub.Guild, DiscordMessageAuthor(msg))
+	}
+
+	scrapeInsert(sub, msg, true)
+
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	sub.seen++
+
+	// The checkpoint can't move past the catch up position until the gap is
+	// filled otherwise a crash would lose the messages in between.
+	if sub.catching {
+		if DiscordIdLess(sub.live, msg.ID) {
+			sub.live = msg.ID
+		}
+		return
+	}
 
-		if _, err := message(guild, channelName, msg); err != nil {
-			Fatal("ERROR: failed to parse '%v': %v", msg.ID, err)
+	sub.advance(msg.ID)
+}
+
+func scrapeUpdate(msg *Message) {
+	sub, ok := subGet(msg.ChannelID)
+	if !ok {
+		return
+	}
+
+	// Discord also sends updates when it unfurls the embeds of a message which
+	// are partial and don't carry the content so the message is fetched again
+	// by the workers to archive the images of its embeds.
+	if msg.EditedTimestamp == "" {
+		if len(msg.Embeds) > 0 {
+			scrapeUnfurl(sub, msg.ID)
 		}
+		return
+	}
 
-		DatabaseSubUpdateLatest(channelId, msg.ID)
+	var ids []string
+	if msg.Attachments != nil {
+		ids = []string{}
+		for _, img := range images(sub.Guild, msg) {
+			ids = append(ids, img.id)
+		}
 	}
+
+	text, tags := caption(sub.Guild, msg, DatabaseAuthorSeen)
+	DatabaseRecordUpdate(ActorScraper, msg.ID, text, tags, ids)
+	Info("update chan:%v msg:%v", msg.ChannelID, msg.ID)
+
+	// Edits can link new images. Their reactions are left to the reaction
+	// events as the updates aren't guaranteed to carry them.
+	scrapeInsert(sub, msg, false)
 }
 
-func scrapeBackwards(guild, channelId, channelName, from string) {
-	it, err := DiscordMessageBackwardsIt(channelId, from)
+// Archives the images of a message that aren't already archived. The reactions
+// of the archived records are replaced by the ones of the message if it's
+// known to carry them.
+func scrapeInsert(sub *Sub, msg *Message, reactions bool) {
+	recs, err := message(sub.Guild, msg, DatabaseAuthorSeen)
 	if err != nil {
-		Fatal("unable to create iterator for '%v': %v", channelId, it)
+		Warning("failed to parse '%v': %v", msg.ID, err)
+		return
 	}
 
-	count := 0
-	for true {
-		msg, err := it.DiscordItNext()
-		if msg == nil {
-			break
-		} else if err != nil {
-			Fatal("unable to read message for '%v': %v", channelId, err)
-			return
+	for _, rec := range recs {
+		if !reactions {
+			rec.Reactions = nil
 		}
+		messageLog(DatabaseRecordInsert(rec), rec)
+	}
+}
 
-		if kept, err := message(guild, channelName, msg); err != nil {
-			Warning("failed to parse '%v': %v", msg.ID, err)
-		} else if kept {
-			count++
+func scrapeUnfurl(sub *Sub, id string) {
+	sub.lock.Lock()
+	for _, pending := range sub.unfurled {
+		if pending == id {
+			sub.lock.Unlock()
+			return
 		}
+	}
+	sub.unfurled = append(sub.unfurled, id)
+	sub.lock.Unlock()
+
+	schedAdd(sub, taskUnfurl, time.Now())
+}
+
+// Fetches one of the unfurled messages and archives the images of its embeds.
+// Returns true if there are more messages to fetch.
+func scrapeUnfurlPage(sub *Sub) (bool, error) {
+	sub.lock.Lock()
+	if len(sub.unfurled) == 0 {
+		sub.lock.Unlock()
+		return false, nil
+	}
+	id := sub.unfurled[0]
+	sub.lock.Unlock()
+
+	// Messages deleted in the meantime are skipped while failures leave the
+	// message queued for the retry.
+	msg, err := DiscordMessage(sub.Channel, id)
+	if err != nil && !DiscordIsUnknownMessage(err) {
+		return false, err
+	}
+
+	sub.lock.Lock()
+	sub.unfurled = sub.unfurled[1:]
+	more := len(sub.unfurled) > 0
+	sub.lock.Unlock()
+
+	if err == nil {
+		scrapeInsert(sub, msg, true)
+	}
+	return more, nil
+}
+
+func scrapeDelete(channel string, ids []string) {
+	if _, ok := subGet(channel); !ok {
+		return
+	}
 
-		DatabaseSubUpdateEarliest(channelId, msg.ID)
+	for _, id := range ids {
+		DatabaseRecordDelete(ActorScraper, id)
+		Info("delete chan:%v msg:%v", channel, id)
 	}
+}
+
+func scrapeMember(guild string, author *Author) {
+	if scrapeGuilds()[guild] {
+		DatabaseAuthorUpdate(ActorScraper, guild, author)
+	}
+}
+
+// Returns the key under which an emoji is counted and the tag it maps to in
+// the guild, if any. Emojis are mapped by name or by key.
+func reaction(guild string, emoji *Emoji) (string, string) {
+	key := emoji.Key()
+	tags := Config.Reactions[guild]
+	if tag, ok := tags[key]; ok {
+		return key, tag
+	}
+	return key, tags[emoji.Name]
+}
+
+func scrapeReaction(channel, msg string, emoji *Emoji, delta int) {
+	sub, ok := subGet(channel)
+	if !ok {
+		return
+	}
+
+	key, tag := reaction(sub.Guild, emoji)
+	DatabaseReactionAdd(ActorScraper, msg, key, delta, tag)
+}
+
+func scrapeReactionClear(channel, msg string) {
+	if _, ok := subGet(channel); !ok {
+		return
+	}
+
+	DatabaseReactionsClear(msg)
+	Info("reactions cleared chan:%v msg:%v", channel, msg)
+}
+
+// Catches up on the messages that were missed while the gateway was
+// disconnected one page at a time. Returns true if there are more pages to
+// fetch.
+func scrapeForwardPage(sub *Sub) (bool, error) {
+	sub.lock.Lock()
+	sub.catching = true
+	from := sub.latest
+	sub.lock.Unlock()
+
+	msgs, err := DiscordMessagesAfter(sub.Channel, from)
+	if err != nil || len(msgs) == 0 {
+		return false, err
+	}
+
+	// Live messages don't move the checkpoint while we're catching up so the
+	// page is the only writer.
+	count := messagePage(sub, msgs, SubLatest)
+
+	sub.lock.Lock()
+	sub.latest = msgs[len(msgs)-1].ID
+	sub.seen += len(msgs)
+	sub.lock.Unlock()
+
+	if count > 0 {
+		Info("caught up %v messages for '%v'", count, sub.Channel)
+	}
+
+	// Without a checkpoint we only get the latest page as the rest of the
+	// history is left to the backfill.
+	return from != "" && len(msgs) == DiscordPageSize, nil
+}
+
+// Ends the catch up and returns the delay until the next poll which shrinks
+// for channels that see activity and grows for quiet ones.
+func scrapeForwardDone(sub *Sub) time.Duration {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	sub.advance(sub.live)
+	sub.catching = false
+
+	if sub.seen > 0 {
+		sub.interval /= 2
+	} else {
+		sub.interval *= 2
+	}
+	if sub.interval < scrapePollMin {
+		sub.interval = scrapePollMin
+	} else if sub.interval > scrapePollMax {
+		sub.interval = scrapePollMax
+	}
+
+	sub.seen = 0
+	return sub.interval
+}
+
+// Archives the history of a channel one page at a time. Returns true if there
+// are more pages to fetch.
+func scrapeBackwardsPage(sub *Sub) (bool, error) {
+	sub.lock.Lock()
+	from := sub.earliest
+	sub.lock.Unlock()
+
+	msgs, err := DiscordMessagesBefore(sub.Channel, from)
+	if err != nil || len(msgs) == 0 {
+		return false, err
+	}
+
+	count := messagePage(sub, msgs, SubEarliest)
+
+	sub.lock.Lock()
+	sub.earliest = msgs[len(msgs)-1].ID
+	sub.lock.Unlock()
 
-	if from != it.Pos {
-		Info("backfilled %v messages for '%v'", count, channelId)
+	if count > 0 {
+		Info("backfilled %v messages for '%v'", count, sub.Channel)
 	}
+	return len(msgs) == DiscordPageSize, nil
 }
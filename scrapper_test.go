@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestHashtagRegex(t *testing.T) {
+	tests := []struct {
+		content string
+		tags    []string
+	}{
+		{"", nil},
+		{"no tags here", nil},
+		{"#cat", []string{"cat"}},
+		{"look #cat and #dog", []string{"cat", "dog"}},
+		{"#cat,#dog", []string{"cat", "dog"}},
+		{"(#cat)", []string{"cat"}},
+		{"#big-cat #snake_case #l33t", []string{"big-cat", "snake_case", "l33t"}},
+		{"#chaton #猫", []string{"chaton", "猫"}},
+		{"#cat!", []string{"cat"}},
+		{"in <#123456> channel", nil},
+		{"html &#39; entity", nil},
+		{"not#atag", nil},
+		{"# lonely", nil},
+	}
+
+	for _, test := range tests {
+		var tags []string
+		for _, match := range hashtagRegex.FindAllStringSubmatch(test.content, -1) {
+			tags = append(tags, match[1])
+		}
+
+		if !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("%q: got %q, expected %q", test.content, tags, test.tags)
+		}
+	}
+}
+
+func TestCaption(t *testing.T) {
+	defer func(saved *discordgo.Session) { discord = saved }(discord)
+	discord, _ = discordgo.New("Bot test")
+
+	// Display names as they would be resolved from the authors table.
+	names := func(guild string, author *Author) string {
+		return map[string]string{"1": "Alice", "2": "bob"}[author.Id]
+	}
+	mentions := []*discordgo.User{{ID: "1", Username: "alice99"}, {ID: "2", Username: "bob"}}
+
+	tests := []struct {
+		content  string
+		mentions []*discordgo.User
+		caption  string
+		tags     []string
+	}{
+		{"plain", nil, "plain", []string{}},
+		{"hi <@1>", mentions[:1], "hi @Alice", []string{"@Alice"}},
+		{"hi <@!1>", mentions[:1], "hi @Alice", []string{"@Alice"}},
+		{"<@1> and <@!2>", mentions, "@Alice and @bob", []string{"@Alice", "@bob"}},
+		{"#cat with <@2> #Dog", mentions[1:], "#cat with @bob #Dog", []string{"cat", "Dog", "@bob"}},
+		{"in <#3> #cat", nil, "in <#3> #cat", []string{"cat"}},
+		{"unknown <@4>", nil, "unknown <@4>", []string{}},
+	}
+
+	for _, test := range tests {
+		msg := &Message{Content: test.content, Mentions: test.mentions}
+		text, tags := caption("10", msg, names)
+
+		if text != test.caption {
+			t.Errorf("%q: got caption %q, expected %q", test.content, text, test.caption)
+		}
+		if !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("%q: got tags %q, expected %q", test.content, tags, test.tags)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Tasks that fail on transient errors are retried with an exponential backoff
+// and full jitter. Tasks that fail on errors that won't go away by retrying
+// pause their sub which is left stopped until it's subscribed again. Either way
+// the state of the sub is recorded in the database for the status command.
+//
+// A rejected token isn't specific to a sub and fails all of them at once so it
+// backs off every task instead of pausing the subs.
+
+const (
+	superviseBase = time.Second
+	superviseMax  = 10 * time.Minute
+)
+
+var superviseReasons = map[int]string{
+	DiscordErrChannel:   "channel unavailable",
+	DiscordErrAuth:      "unauthorized",
+	DiscordErrPermanent: "rejected",
+}
+
+var (
+	superviseAuthLock    sync.Mutex
+	superviseAuthAttempt int
+	superviseAuthUntil   time.Time
+)
+
+func superviseBackoff(attempt int) time.Duration {
+	delay := superviseMax
+	if attempt < 20 {
+		if shifted := superviseBase << uint(attempt); shifted < superviseMax {
+			delay = shifted
+		}
+	}
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+// Returns the delay before the failed task is retried or false if the sub was
+// paused.
+func supervise(sub *Sub, name string, attempt int, err error) (time.Duration, bool) {
+	class := DiscordClassify(err)
+	if class == DiscordErrAuth {
+		reason := superviseReasons[class] + ": " + err.Error()
+		delay := superviseAuthFailed()
+		Warning("%v failed for '%v', backing off all tasks for %v: %v", name, sub.Channel, delay, reason)
+		DatabaseSubState(sub.Channel, SubErrored, reason)
+		return delay, true
+	}
+
+	if class != DiscordErrRetry {
+		reason := superviseReasons[class] + ": " + err.Error()
+		Warning("%v failed for '%v', pausing: %v", name, sub.Channel, reason)
+		supervisePause(sub, reason)
+		return 0, false
+	}
+
+	delay := superviseBackoff(attempt)
+	Warning("%v failed for '%v', retrying in %v: %v", name, sub.Channel, delay, err)
+	DatabaseSubState(sub.Channel, SubErrored, err.Error())
+	return delay, true
+}
+
+func superviseRecovered(sub *Sub, name string) {
+	superviseAuthRecovered()
+	DatabaseSubState(sub.Channel, SubHealthy, "")
+	Info("%v recovered for '%v'", name, sub.Channel)
+}
+
+func supervisePause(sub *Sub, reason string) {
+	DatabaseSubState(sub.Channel, SubPaused, reason)
+
+	subsLock.Lock()
+	defer subsLock.Unlock()
+
+	scrapeStop(sub)
+}
+
+// Backs off every task after the token was rejected. Concurrent failures only
+// extend the current backoff.
+func superviseAuthFailed() time.Duration {
+	superviseAuthLock.Lock()
+	defer superviseAuthLock.Unlock()
+
+	now := time.Now()
+	if now.Before(superviseAuthUntil) {
+		return superviseAuthUntil.Sub(now)
+	}
+
+	delay := superviseBackoff(superviseAuthAttempt)
+	superviseAuthAttempt++
+	superviseAuthUntil = now.Add(delay)
+	return delay
+}
+
+// Returns how long tasks must wait for the token backoff to expire.
+func superviseAuthWait() time.Duration {
+	superviseAuthLock.Lock()
+	defer superviseAuthLock.Unlock()
+
+	return time.Until(superviseAuthUntil)
+}
+
+func superviseAuthRecovered() {
+	superviseAuthLock.Lock()
+	defer superviseAuthLock.Unlock()
+
+	superviseAuthAttempt = 0
+	superviseAuthUntil = time.Time{}
+}
@@ -0,0 +1,120 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSuperviseAuth(t *testing.T) {
+	testDatabase(t)
+	mux := testDiscord(t)
+
+	defer func(saved []*task) { schedTasks = saved }(schedTasks)
+	schedTasks = []*task{}
+	superviseAuthRecovered()
+	defer superviseAuthRecovered()
+
+	// The token is rejected until it's fixed.
+	calls := 0
+	rejected := true
+	mux.HandleFunc("/channels/", func(writer http.ResponseWriter, req *http.Request) {
+		calls++
+		if rejected {
+			writer.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(writer, `{"code": 0, "message": "401: Unauthorized"}`)
+			return
+		}
+		fmt.Fprint(writer, `[]`)
+	})
+
+	DatabaseSubSeed("1", "2")
+	DatabaseSubSeed("1", "3")
+	state := func(channel string) string {
+		for _, entry := range DatabaseSubs() {
+			if entry.Channel == channel {
+				return entry.State
+			}
+		}
+		return ""
+	}
+
+	first := &Sub{Guild: "1", Channel: "2", latest: "10", stop: make(chan struct{})}
+	second := &Sub{Guild: "1", Channel: "3", latest: "10", stop: make(chan struct{})}
+	schedAdd(first, taskForward, time.Now())
+	schedAdd(second, taskForward, time.Now())
+
+	// The rejection backs off every task instead of pausing the sub.
+	before := time.Now()
+	task, _ := schedPick()
+	schedRun(task)
+	if calls != 1 {
+		t.Fatalf("rejected: expected a single request, got %v", calls)
+	}
+
+	superviseAuthLock.Lock()
+	until := superviseAuthUntil
+	superviseAuthLock.Unlock()
+	if !until.After(before) || until.After(before.Add(superviseBase)) {
+		t.Errorf("rejected: got a backoff of %v, expected at most %v", until.Sub(before), superviseBase)
+	}
+	if task.attempt != 1 || !task.at.After(before) || task.sub.stopped() {
+		t.Errorf("rejected: expected the task to be retried later, got %+v", *task)
+	}
+	if got := state(task.sub.Channel); got != SubErrored {
+		t.Errorf("rejected: got state %q, expected %q", got, SubErrored)
+	}
+
+	// The other sub waits for the backoff without hitting Discord. The backoff
+	// is stretched such that it can't expire before the task runs.
+	superviseAuthLock.Lock()
+	superviseAuthUntil = time.Now().Add(time.Minute)
+	superviseAuthLock.Unlock()
+
+	other, _ := schedPick()
+	if other == nil || other == task {
+		t.Fatalf("backoff: expected the other task to be due")
+	}
+	schedRun(other)
+	if calls != 1 {
+		t.Errorf("backoff: expected no request, got %v", calls-1)
+	}
+	if other.attempt != 0 || other.at.Before(time.Now().Add(30*time.Second)) {
+		t.Errorf("backoff: expected the task to wait for the backoff, got %+v", *other)
+	}
+
+	// Failures past the backoff grow it.
+	superviseAuthLock.Lock()
+	superviseAuthUntil = time.Now()
+	superviseAuthLock.Unlock()
+
+	task.at = time.Now()
+	task.running = true
+	schedRun(task)
+	if superviseAuthAttempt != 2 || task.attempt != 2 {
+		t.Errorf("rejected again: got attempts %v/%v, expected 2", superviseAuthAttempt, task.attempt)
+	}
+
+	// A successful page clears the backoff and the sub's error.
+	rejected = false
+	superviseAuthLock.Lock()
+	superviseAuthUntil = time.Now()
+	superviseAuthLock.Unlock()
+
+	task.at = time.Now()
+	task.running = true
+	schedRun(task)
+	if wait := superviseAuthWait(); wait > 0 || superviseAuthAttempt != 0 {
+		t.Errorf("recovered: got a backoff of %v after %v attempts", wait, superviseAuthAttempt)
+	}
+	if task.attempt != 0 {
+		t.Errorf("recovered: got attempt %v", task.attempt)
+	}
+	if got := state(task.sub.Channel); got != SubHealthy {
+		t.Errorf("recovered: got state %q, expected %q", got, SubHealthy)
+	}
+}